@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Abort causes
+const (
+	// AbortCauseController ...
+	AbortCauseController = "controller"
+	// AbortCauseUser ...
+	AbortCauseUser = "user"
+	// AbortCauseBitrise ...
+	AbortCauseBitrise = "bitrise"
+)
+
+// controllerAbortPrefix marks the abort reasons sent by the controller, so its aborts can be told apart from the others.
+const controllerAbortPrefix = "Aborted by the controller: "
+
+// Reasons of the controller's aborts
+const (
+	abortReasonFailFast      = "an other build failed"
+	abortReasonInterrupted   = "the controller was interrupted"
+	abortReasonTriggerFailed = "failed to trigger an other build"
+	abortReasonUnknownStatus = "the build status was unrecognized for too long"
+)
+
+// userAbortPattern matches the abort reason Bitrise sets when a user aborts a build (like "User john requested to abort this build.").
+var userAbortPattern = regexp.MustCompile(`(?i)^user\s+(\S+)\s+requested`)
+
+// classifyAbort returns the cause of an abort and the aborting user (if the API provides it) based on the build's abort reason.
+// Aborts neither sent by the controller nor by a user are attributed to Bitrise (like build timeouts).
+func classifyAbort(reason string) (cause, abortedBy string) {
+	if strings.HasPrefix(reason, controllerAbortPrefix) {
+		return AbortCauseController, ""
+	}
+	if match := userAbortPattern.FindStringSubmatch(reason); match != nil {
+		return AbortCauseUser, match[1]
+	}
+	return AbortCauseBitrise, ""
+}
+
+// setAbort records the abort reason of an aborted build.
+func (b *BuildInfo) setAbort(reason string) {
+	b.AbortCause, b.AbortedBy = classifyAbort(reason)
+	b.AbortReason = strings.TrimPrefix(reason, controllerAbortPrefix)
+}
+
+// markAbortedByController records an abort of the controller on a build which was still running.
+func (b *BuildInfo) markAbortedByController(reason string) {
+	b.RawStatus = StatusAborted
+	b.Status = stateColor(StatusAborted)(StatusAborted)
+	b.setAbort(controllerAbortPrefix + reason)
+}
+
+// AbortSummary describes who aborted the build and why, it is empty for builds which weren't aborted.
+func (b BuildInfo) AbortSummary() string {
+	if b.AbortCause == "" {
+		return ""
+	}
+
+	summary := "aborted by " + b.AbortCause
+	if b.AbortedBy != "" {
+		summary += " (" + b.AbortedBy + ")"
+	}
+	if b.AbortReason != "" {
+		summary += ": " + b.AbortReason
+	}
+	return summary
+}
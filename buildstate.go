@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bitrise-io/go-utils/colorstring"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// unknownStatusTimeout is how long a build may report an unrecognized status before it is considered failed (and aborted),
+// so a new Bitrise status can't keep the controller polling forever.
+// It is a variable, so the tests can shorten it.
+var unknownStatusTimeout = 10 * time.Minute
+
+// buildState returns the state of a build (one of the Status... consts) based on its numeric status and on-hold flag.
+// The status text is only informational, an unrecognized numeric status is StatusUnknown.
+func buildState(build Build) string {
+	switch build.Status {
+	case 0:
+		if build.IsOnHold {
+			return StatusOnHold
+		}
+		return StatusInProgress
+	case 1:
+		return StatusFinishedWithSuccess
+	case 2:
+		return StatusFinishedWithError
+	case 3:
+		return StatusAborted
+	case 4:
+		return StatusAbortedWithSuccess
+	default:
+		return StatusUnknown
+	}
+}
+
+// isFinalState reports whether a build in the given state is finished.
+// StatusUnknown is not final: the build is polled until it reaches a known state (or unknownStatusTimeout passes).
+func isFinalState(state string) bool {
+	switch state {
+	case StatusFinishedWithSuccess, StatusFinishedWithError, StatusAborted, StatusAbortedWithSuccess:
+		return true
+	default:
+		return false
+	}
+}
+
+// stateColor returns the color of a state in the console output and the summary table.
+func stateColor(state string) colorstring.ColorFunc {
+	switch state {
+	case StatusFinishedWithSuccess:
+		return colorstring.Green
+	case StatusFinishedWithError:
+		return colorstring.Red
+	case StatusAborted, StatusAbortedWithSuccess:
+		return colorstring.Yellow
+	case StatusUnknown:
+		return colorstring.Blue
+	default:
+		return colorstring.NoColor
+	}
+}
+
+// buildStateMachine tracks the state of a polled build, logging its transitions and calling the registered callbacks.
+type buildStateMachine struct {
+	id           string
+	state        string
+	enteredAt    time.Time
+	onEnter      map[string][]func(from string, build Build)
+	onTransition []func(from, to string, build Build)
+}
+
+func newBuildStateMachine(id string) *buildStateMachine {
+	return &buildStateMachine{
+		id:      id,
+		onEnter: map[string][]func(from string, build Build){},
+	}
+}
+
+// OnEnter registers a callback called when the build enters the given state.
+func (m *buildStateMachine) OnEnter(state string, callback func(from string, build Build)) {
+	m.onEnter[state] = append(m.onEnter[state], callback)
+}
+
+// OnTransition registers a callback called on every state change.
+func (m *buildStateMachine) OnTransition(callback func(from, to string, build Build)) {
+	m.onTransition = append(m.onTransition, callback)
+}
+
+// Update moves the machine to the state of the polled build and returns the new state.
+func (m *buildStateMachine) Update(build Build) string {
+	state := buildState(build)
+	if state == m.state {
+		return state
+	}
+
+	from := m.state
+	m.state = state
+	m.enteredAt = time.Now()
+
+	fmt.Println()
+	if state == StatusUnknown {
+		log.Warnf("[%s] Unrecognized build status: %d (%s)", m.id, build.Status, build.StatusText)
+	} else if from == "" {
+		log.Printf("[%s] State: %s", m.id, state)
+	} else {
+		log.Printf("[%s] State: %s -> %s", m.id, from, state)
+	}
+
+	for _, callback := range m.onTransition {
+		callback(from, state, build)
+	}
+	for _, callback := range m.onEnter[state] {
+		callback(from, build)
+	}
+
+	return state
+}
+
+// InStateFor returns how long the build has been in its current state.
+func (m *buildStateMachine) InStateFor() time.Duration {
+	return time.Since(m.enteredAt)
+}
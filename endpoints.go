@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Service endpoints, configurable for self-hosted setups, proxies and stand-in servers.
+var (
+	// baseURL is the Bitrise API's base URL.
+	baseURL = "https://api.bitrise.io/v0.1"
+	// appBaseURL is the Bitrise website's base URL, it serves the legacy build trigger hook and the build pages.
+	appBaseURL = "https://app.bitrise.io"
+	// slackAPIURL is the Slack Web API's base URL.
+	slackAPIURL = "https://slack.com/api"
+)
+
+// setEndpoints overrides the service endpoints, empty values keep the defaults.
+func setEndpoints(apiBaseURL, appURL, slackURL string) error {
+	for _, endpoint := range []struct {
+		name  string
+		value string
+		dest  *string
+	}{
+		{"api_base_url", apiBaseURL, &baseURL},
+		{"app_base_url", appURL, &appBaseURL},
+		{"slack_api_url", slackURL, &slackAPIURL},
+	} {
+		value := strings.TrimRight(strings.TrimSpace(endpoint.value), "/")
+		if value == "" {
+			continue
+		}
+
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %s: %s is not an http(s) URL", endpoint.name, endpoint.value)
+		}
+		*endpoint.dest = value
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvs parses the dotenv-style envs input.
+//
+// Supported syntax:
+//
+//	# comment
+//	export KEY=value           // optional export prefix
+//	KEY=value=with=equal signs // unquoted values are trimmed, a ' #' starts an inline comment
+//	KEY="double quoted\tvalue" // supports \n, \r, \t, \" and \\ escapes, may span multiple lines
+//	KEY='single quoted value'  // taken literally, may span multiple lines
+//
+// Single quoted values are passed with is_expand: false (like in a shell, they are not expanded in the child build),
+// every other value is passed with is_expand: true.
+// If a key is defined multiple times, the last definition wins.
+func parseEnvs(s string) ([]BuildParamsEnvironment, error) {
+	var envs []BuildParamsEnvironment
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := strings.TrimSpace(strings.TrimSuffix(lines[i], "\r"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "export ") || strings.HasPrefix(line, "export\t") {
+			line = strings.TrimSpace(line[len("export"):])
+		}
+
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: missing '=' in %q", lineNum, line)
+		}
+
+		key := strings.TrimSpace(line[:idx])
+		if !envKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNum, key)
+		}
+
+		value := strings.TrimLeft(line[idx+1:], " \t")
+		isExpand := true
+
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, `'`) {
+			quote := value[0]
+			rest := value[1:]
+
+			var b strings.Builder
+			for {
+				end := closingQuoteIndex(rest, quote)
+				if end != -1 {
+					b.WriteString(rest[:end])
+
+					trailing := strings.TrimSpace(rest[end+1:])
+					if trailing != "" && !strings.HasPrefix(trailing, "#") {
+						return nil, fmt.Errorf("line %d: unexpected characters after the closing quote: %q", i+1, trailing)
+					}
+					break
+				}
+
+				b.WriteString(rest)
+				b.WriteString("\n")
+
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("line %d: unterminated quoted value of %s", lineNum, key)
+				}
+				rest = strings.TrimSuffix(lines[i], "\r")
+			}
+
+			if quote == '"' {
+				value = unescapeEnvValue(b.String())
+			} else {
+				value = b.String()
+				isExpand = false
+			}
+		} else {
+			if idx := strings.Index(value, " #"); idx != -1 {
+				value = value[:idx]
+			}
+			value = strings.TrimSpace(value)
+		}
+
+		envs = setEnv(envs, BuildParamsEnvironment{
+			MappedTo: key,
+			Value:    value,
+			IsExpand: isExpand,
+		})
+	}
+
+	return envs, nil
+}
+
+// setEnv adds env to envs, or replaces the env with the same key.
+func setEnv(envs []BuildParamsEnvironment, env BuildParamsEnvironment) []BuildParamsEnvironment {
+	for i, e := range envs {
+		if e.MappedTo == env.MappedTo {
+			envs[i] = env
+			return envs
+		}
+	}
+	return append(envs, env)
+}
+
+func closingQuoteIndex(s string, quote byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i
+		}
+	}
+	return -1
+}
+
+func unescapeEnvValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
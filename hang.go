@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Hang detection modes
+const (
+	// HangDetectionWallClock reports a build as hanging if it is still running after the hang timeout.
+	HangDetectionWallClock = "wall_clock"
+	// HangDetectionLogInactivity reports a build as hanging if it produced no log output for the inactivity window.
+	HangDetectionLogInactivity = "log_inactivity"
+)
+
+const hangLogTailLines = 10
+
+// hangTimers runs the timer based warnings of a build.
+//
+// The queue warning fires if the build doesn't start on a worker within the queue timeout.
+// The hang warning (wall-clock mode only) fires if the build is still running the hang timeout after it started on a worker,
+// so time spent waiting for a machine doesn't count.
+type hangTimers struct {
+	warning HangingBuildWarning
+	onHang  func()
+	queue   *time.Timer
+	hang    *time.Timer
+	started bool
+}
+
+func startHangTimers(warning HangingBuildWarning, onQueued, onHang func()) *hangTimers {
+	t := &hangTimers{
+		warning: warning,
+		onHang:  onHang,
+	}
+	if warning.QueueTimeout > 0 {
+		t.queue = time.AfterFunc(warning.QueueTimeout, onQueued)
+	}
+	return t
+}
+
+// buildStarted stops the queue warning and starts the hang clock from the worker start time.
+func (t *hangTimers) buildStarted(startedAt time.Time) {
+	if t.started {
+		return
+	}
+	t.started = true
+
+	if t.queue != nil {
+		t.queue.Stop()
+	}
+
+	if t.warning.Mode == HangDetectionLogInactivity {
+		return
+	}
+
+	remaining := t.warning.Timeout - time.Since(startedAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	t.hang = time.AfterFunc(remaining, t.onHang)
+}
+
+func (t *hangTimers) stop() {
+	if t.queue != nil {
+		t.queue.Stop()
+	}
+	if t.hang != nil {
+		t.hang.Stop()
+	}
+}
+
+// workerStartTime returns when the build started on a worker, if it did.
+func workerStartTime(build Build) (time.Time, bool) {
+	if build.StartedOnWorkerAt == nil {
+		return time.Time{}, false
+	}
+	startedAt, err := time.Parse(time.RFC3339, *build.StartedOnWorkerAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return startedAt, true
+}
+
+// logWatcher follows the log of a running build and tracks when it produced output for the last time.
+type logWatcher struct {
+	window       time.Duration
+	lastPosition int
+	lastActivity time.Time
+	tail         []string
+	warned       bool
+}
+
+func newLogWatcher(window time.Duration, now time.Time) *logWatcher {
+	return &logWatcher{
+		window:       window,
+		lastPosition: -1,
+		lastActivity: now,
+	}
+}
+
+// update processes the polled log, and reports whether the build became inactive since the previous update.
+// A build is reported only once per inactivity period, new log output re-arms the watcher.
+func (w *logWatcher) update(buildLog BuildLog, now time.Time) bool {
+	for _, chunk := range buildLog.LogChunks {
+		if chunk.Position <= w.lastPosition {
+			continue
+		}
+
+		w.lastPosition = chunk.Position
+		w.lastActivity = now
+		w.warned = false
+		w.appendTail(chunk.Chunk)
+	}
+
+	if w.warned || now.Sub(w.lastActivity) < w.window {
+		return false
+	}
+	w.warned = true
+	return true
+}
+
+func (w *logWatcher) appendTail(chunk string) {
+	lines := strings.Split(strings.TrimRight(chunk, "\n"), "\n")
+	w.tail = append(w.tail, lines...)
+	if len(w.tail) > hangLogTailLines {
+		w.tail = w.tail[len(w.tail)-hangLogTailLines:]
+	}
+}
+
+// Tail returns the last lines of the build log.
+func (w *logWatcher) Tail() string {
+	return strings.Join(w.tail, "\n")
+}
+
+// InactiveFor returns the time passed since the build's last log output.
+func (w *logWatcher) InactiveFor(now time.Time) time.Duration {
+	return now.Sub(w.lastActivity)
+}
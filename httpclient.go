@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// httpClient sends every Bitrise API and Slack request of the controller.
+var httpClient = http.DefaultClient
+
+// HTTPConfig configures the transport of the controller's HTTP requests.
+type HTTPConfig struct {
+	// Timeout bounds each request (including reading the response body), 0 means no timeout.
+	Timeout time.Duration
+	// ProxyURL is the proxy of every request, if empty the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY envs.
+	ProxyURL string
+	// CABundlePath is a PEM file of CA certificates trusted in addition to the system ones (like the one of a TLS-intercepting proxy).
+	CABundlePath string
+	// ClientCertPath and ClientKeyPath are the PEM files of the client certificate used for mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+// newHTTPClient returns a client with the given transport configuration.
+func newHTTPClient(config HTTPConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy_url: not a URL")
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CABundlePath != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(config.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_bundle: %s", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid ca_bundle: no PEM certificates found in %s", config.CABundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (config.ClientCertPath == "") != (config.ClientKeyPath == "") {
+		return nil, fmt.Errorf("client_certificate and client_key must be set together")
+	}
+	if config.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}, nil
+}
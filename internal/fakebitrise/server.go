@@ -0,0 +1,652 @@
+// Package fakebitrise is an in-process stand-in of the Bitrise API for hermetic tests.
+//
+// It implements the build trigger, get build, list builds, abort and build log endpoints,
+// and the get and abort endpoints of pipelines.
+// The builds follow the status sequence scripted for their workflow, and every endpoint
+// can be slowed down or made to fail.
+package fakebitrise
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints
+const (
+	// EndpointTrigger is POST /apps/{app}/builds (and the legacy POST /app/{app}/build/start.json hook).
+	EndpointTrigger = "trigger"
+	// EndpointListBuilds is GET /apps/{app}/builds.
+	EndpointListBuilds = "list-builds"
+	// EndpointGetBuild is GET /apps/{app}/builds/{build}.
+	EndpointGetBuild = "get-build"
+	// EndpointAbort is POST /apps/{app}/builds/{build}/abort.
+	EndpointAbort = "abort"
+	// EndpointLog is GET /apps/{app}/builds/{build}/log.
+	EndpointLog = "log"
+	// EndpointGetPipeline is GET /apps/{app}/pipelines/{pipeline}.
+	EndpointGetPipeline = "get-pipeline"
+	// EndpointAbortPipeline is POST /apps/{app}/pipelines/{pipeline}/abort.
+	EndpointAbortPipeline = "abort-pipeline"
+)
+
+// Build statuses
+const (
+	StatusRunning            = 0
+	StatusSuccess            = 1
+	StatusError              = 2
+	StatusAborted            = 3
+	StatusAbortedWithSuccess = 4
+)
+
+// Phase is a step of a build's scripted status sequence.
+type Phase struct {
+	Status   int
+	IsOnHold bool
+	// StatusText defaults to the text of the status.
+	StatusText  string
+	AbortReason string
+	// Polls is the number of get build requests the phase lasts, the last phase lasts until the build is aborted.
+	Polls int
+	// Log is appended to the build log when the phase starts.
+	Log []string
+}
+
+// TriggerRequest is a recorded build trigger.
+type TriggerRequest struct {
+	AppSlug   string
+	BuildSlug string
+	// Hook is true if the build was triggered through the legacy build trigger hook.
+	Hook   bool
+	Params json.RawMessage
+}
+
+// AbortRequest is a recorded build (or pipeline) abort.
+type AbortRequest struct {
+	AppSlug   string
+	BuildSlug string
+	// PipelineID is set instead of BuildSlug for pipeline aborts.
+	PipelineID  string
+	AbortReason string
+}
+
+// Stage is a stage of a scripted pipeline, its workflows run in parallel.
+type Stage struct {
+	Name      string
+	Workflows []string
+}
+
+type injectedError struct {
+	statusCode int
+	remaining  int
+}
+
+type build struct {
+	appSlug  string
+	slug     string
+	number   int
+	workflow string
+	params   json.RawMessage
+
+	phases     []Phase
+	phase      int
+	polls      int
+	aborted    *Phase
+	logChunks  []string
+	triggered  time.Time
+	startedAt  *time.Time
+	finishedAt *time.Time
+}
+
+type pipeline struct {
+	appSlug string
+	id      string
+	name    string
+	params  json.RawMessage
+
+	stages []Stage
+	// builds holds the builds of the started stages, by stage.
+	builds  [][]*build
+	aborted bool
+}
+
+// Server is the fake Bitrise API, its URL is the API's base URL (like https://api.bitrise.io/v0.1).
+type Server struct {
+	*httptest.Server
+
+	mux       sync.Mutex
+	scripts   map[string][]Phase
+	stages    map[string][]Stage
+	builds    map[string]*build
+	order     []string
+	pipelines map[string]*pipeline
+	errors    map[string]*injectedError
+	delays    map[string]time.Duration
+	triggers  []TriggerRequest
+	aborts    []AbortRequest
+}
+
+// New starts a fake Bitrise API server, close it with Close.
+func New() *Server {
+	s := &Server{
+		scripts:   map[string][]Phase{},
+		stages:    map[string][]Stage{},
+		builds:    map[string]*build{},
+		pipelines: map[string]*pipeline{},
+		errors:    map[string]*injectedError{},
+		delays:    map[string]time.Duration{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Script sets the status sequence of the builds triggered for the workflow (or pipeline) ID.
+// Builds of not scripted workflows succeed on the first poll.
+func (s *Server) Script(workflowID string, phases ...Phase) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.scripts[workflowID] = phases
+}
+
+// ScriptPipeline sets the stages of the pipelines triggered for the pipeline ID.
+// A stage starts once every build of the previous stage succeeded, the builds follow the script of their workflow.
+func (s *Server) ScriptPipeline(pipelineID string, stages ...Stage) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.stages[pipelineID] = stages
+}
+
+// FailRequests makes the next count requests of the endpoint fail with the HTTP status code.
+func (s *Server) FailRequests(endpoint string, statusCode, count int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.errors[endpoint] = &injectedError{statusCode: statusCode, remaining: count}
+}
+
+// Delay delays every response of the endpoint.
+func (s *Server) Delay(endpoint string, delay time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.delays[endpoint] = delay
+}
+
+// Triggers returns the recorded build triggers.
+func (s *Server) Triggers() []TriggerRequest {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]TriggerRequest(nil), s.triggers...)
+}
+
+// Aborts returns the recorded build and pipeline aborts.
+func (s *Server) Aborts() []AbortRequest {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]AbortRequest(nil), s.aborts...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 4 && parts[0] == "app" && parts[2] == "build" && parts[3] == "start.json" && r.Method == http.MethodPost:
+		s.serve(w, r, EndpointTrigger, func() (int, interface{}) { return s.trigger(r, parts[1], true) })
+	case len(parts) == 3 && parts[0] == "apps" && parts[2] == "builds" && r.Method == http.MethodPost:
+		s.serve(w, r, EndpointTrigger, func() (int, interface{}) { return s.trigger(r, parts[1], false) })
+	case len(parts) == 3 && parts[0] == "apps" && parts[2] == "builds" && r.Method == http.MethodGet:
+		s.serve(w, r, EndpointListBuilds, func() (int, interface{}) { return s.listBuilds(r, parts[1]) })
+	case len(parts) == 4 && parts[0] == "apps" && parts[2] == "builds" && r.Method == http.MethodGet:
+		s.serve(w, r, EndpointGetBuild, func() (int, interface{}) { return s.getBuild(parts[1], parts[3]) })
+	case len(parts) == 5 && parts[0] == "apps" && parts[2] == "builds" && parts[4] == "abort" && r.Method == http.MethodPost:
+		s.serve(w, r, EndpointAbort, func() (int, interface{}) { return s.abort(r, parts[1], parts[3]) })
+	case len(parts) == 5 && parts[0] == "apps" && parts[2] == "builds" && parts[4] == "log" && r.Method == http.MethodGet:
+		s.serve(w, r, EndpointLog, func() (int, interface{}) { return s.buildLog(parts[1], parts[3]) })
+	case len(parts) == 4 && parts[0] == "apps" && parts[2] == "pipelines" && r.Method == http.MethodGet:
+		s.serve(w, r, EndpointGetPipeline, func() (int, interface{}) { return s.getPipeline(parts[1], parts[3]) })
+	case len(parts) == 5 && parts[0] == "apps" && parts[2] == "pipelines" && parts[4] == "abort" && r.Method == http.MethodPost:
+		s.serve(w, r, EndpointAbortPipeline, func() (int, interface{}) { return s.abortPipeline(r, parts[1], parts[3]) })
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, endpoint string, handler func() (int, interface{})) {
+	s.mux.Lock()
+	delay := s.delays[endpoint]
+	var statusCode int
+	if injected := s.errors[endpoint]; injected != nil && injected.remaining > 0 {
+		injected.remaining--
+		statusCode = injected.statusCode
+	}
+	s.mux.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+
+	if statusCode != 0 {
+		writeJSON(w, statusCode, map[string]string{"message": "injected error"})
+		return
+	}
+
+	statusCode, response := handler()
+	writeJSON(w, statusCode, response)
+}
+
+func (s *Server) trigger(r *http.Request, appSlug string, hook bool) (int, interface{}) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	var params struct {
+		BuildParams json.RawMessage `json:"build_params"`
+	}
+	var buildParams struct {
+		WorkflowID string `json:"workflow_id"`
+		PipelineID string `json:"pipeline_id"`
+	}
+	if err := json.Unmarshal(body, &params); err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+	if err := json.Unmarshal(params.BuildParams, &buildParams); err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	workflow := buildParams.WorkflowID
+	if workflow == "" {
+		workflow = buildParams.PipelineID
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// A triggered pipeline's ID is returned as the build slug.
+	var slug string
+	if stages, ok := s.stages[buildParams.PipelineID]; ok {
+		p := &pipeline{
+			appSlug: appSlug,
+			id:      fmt.Sprintf("pipeline-%d", len(s.pipelines)+1),
+			name:    buildParams.PipelineID,
+			params:  params.BuildParams,
+			stages:  stages,
+		}
+		s.pipelines[p.id] = p
+		s.startStage(p)
+		slug = p.id
+	} else {
+		slug = s.newBuild(appSlug, workflow, params.BuildParams).slug
+	}
+
+	s.triggers = append(s.triggers, TriggerRequest{
+		AppSlug:   appSlug,
+		BuildSlug: slug,
+		Hook:      hook,
+		Params:    body,
+	})
+
+	return http.StatusCreated, map[string]string{
+		"status":     "ok",
+		"slug":       appSlug,
+		"build_slug": slug,
+	}
+}
+
+func (s *Server) newBuild(appSlug, workflow string, params json.RawMessage) *build {
+	phases := s.scripts[workflow]
+	if len(phases) == 0 {
+		phases = []Phase{{Status: StatusSuccess}}
+	}
+
+	b := &build{
+		appSlug:   appSlug,
+		slug:      fmt.Sprintf("build-%d", len(s.order)+1),
+		number:    len(s.order) + 1,
+		workflow:  workflow,
+		params:    params,
+		phases:    phases,
+		triggered: time.Now(),
+	}
+	s.builds[b.slug] = b
+	s.order = append(s.order, b.slug)
+	return b
+}
+
+// startStage starts the builds of the pipeline's next stage.
+func (s *Server) startStage(p *pipeline) {
+	stage := p.stages[len(p.builds)]
+
+	var builds []*build
+	for _, workflow := range stage.Workflows {
+		builds = append(builds, s.newBuild(p.appSlug, workflow, p.params))
+	}
+	p.builds = append(p.builds, builds)
+}
+
+func (s *Server) listBuilds(r *http.Request, appSlug string) (int, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	status := r.URL.Query().Get("status")
+
+	var builds []map[string]interface{}
+	for _, slug := range s.order {
+		b := s.builds[slug]
+		if b.appSlug != appSlug {
+			continue
+		}
+		response := b.response()
+		if status != "" && fmt.Sprint(response["status"]) != status {
+			continue
+		}
+		builds = append(builds, response)
+	}
+	return http.StatusOK, map[string]interface{}{"data": builds}
+}
+
+func (s *Server) getBuild(appSlug, buildSlug string) (int, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	b, ok := s.builds[buildSlug]
+	if !ok || b.appSlug != appSlug {
+		return http.StatusNotFound, map[string]string{"message": "Not Found"}
+	}
+
+	b.poll()
+	return http.StatusOK, map[string]interface{}{"data": b.response()}
+}
+
+func (s *Server) abort(r *http.Request, appSlug, buildSlug string) (int, interface{}) {
+	var params struct {
+		AbortReason string `json:"abort_reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	b, ok := s.builds[buildSlug]
+	if !ok || b.appSlug != appSlug {
+		return http.StatusNotFound, map[string]string{"message": "Not Found"}
+	}
+	if status := b.current().Status; status >= StatusSuccess && status <= StatusAbortedWithSuccess {
+		return http.StatusBadRequest, map[string]string{"message": "Build already finished"}
+	}
+
+	s.aborts = append(s.aborts, AbortRequest{
+		AppSlug:     appSlug,
+		BuildSlug:   buildSlug,
+		AbortReason: params.AbortReason,
+	})
+	now := time.Now()
+	b.aborted = &Phase{Status: StatusAborted, AbortReason: params.AbortReason}
+	b.finishedAt = &now
+
+	return http.StatusOK, map[string]string{"status": "ok"}
+}
+
+func (s *Server) getPipeline(appSlug, pipelineID string) (int, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	p, ok := s.pipelines[pipelineID]
+	if !ok || p.appSlug != appSlug {
+		return http.StatusNotFound, map[string]string{"message": "Not Found"}
+	}
+
+	if p.status() == pipelineStatusRunning && len(p.builds) < len(p.stages) && stageStatus(p.builds[len(p.builds)-1]) == pipelineStatusSucceeded {
+		s.startStage(p)
+	}
+	return http.StatusOK, p.response()
+}
+
+func (s *Server) abortPipeline(r *http.Request, appSlug, pipelineID string) (int, interface{}) {
+	var params struct {
+		AbortReason string `json:"abort_reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	p, ok := s.pipelines[pipelineID]
+	if !ok || p.appSlug != appSlug {
+		return http.StatusNotFound, map[string]string{"message": "Not Found"}
+	}
+	if p.status() != pipelineStatusRunning {
+		return http.StatusBadRequest, map[string]string{"message": "Pipeline already finished"}
+	}
+
+	s.aborts = append(s.aborts, AbortRequest{
+		AppSlug:     appSlug,
+		PipelineID:  pipelineID,
+		AbortReason: params.AbortReason,
+	})
+	p.aborted = true
+
+	// Aborting a pipeline aborts its running builds too.
+	now := time.Now()
+	for _, builds := range p.builds {
+		for _, b := range builds {
+			if b.current().Status == StatusRunning {
+				b.aborted = &Phase{Status: StatusAborted, AbortReason: params.AbortReason}
+				b.finishedAt = &now
+			}
+		}
+	}
+
+	return http.StatusOK, map[string]string{"status": "ok"}
+}
+
+func (s *Server) buildLog(appSlug, buildSlug string) (int, interface{}) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	b, ok := s.builds[buildSlug]
+	if !ok || b.appSlug != appSlug {
+		return http.StatusNotFound, map[string]string{"message": "Not Found"}
+	}
+
+	var chunks []map[string]interface{}
+	for i, chunk := range b.logChunks {
+		chunks = append(chunks, map[string]interface{}{
+			"chunk":    chunk,
+			"position": i + 1,
+		})
+	}
+	return http.StatusOK, map[string]interface{}{
+		"log_chunks":  chunks,
+		"is_archived": b.finishedAt != nil,
+	}
+}
+
+func (b *build) current() Phase {
+	if b.aborted != nil {
+		return *b.aborted
+	}
+	return b.phases[b.phase]
+}
+
+// poll advances the build in its scripted status sequence.
+func (b *build) poll() {
+	if b.aborted != nil {
+		return
+	}
+
+	if b.polls == 0 {
+		b.enter()
+	}
+	b.polls++
+
+	if b.polls > b.phases[b.phase].Polls && b.phase < len(b.phases)-1 {
+		b.phase++
+		b.polls = 1
+		b.enter()
+	}
+}
+
+func (b *build) enter() {
+	phase := b.phases[b.phase]
+	b.logChunks = append(b.logChunks, phase.Log...)
+
+	now := time.Now()
+	if b.startedAt == nil && !(phase.Status == StatusRunning && phase.IsOnHold) {
+		b.startedAt = &now
+	}
+	if phase.Status != StatusRunning {
+		b.finishedAt = &now
+	}
+}
+
+func (b *build) response() map[string]interface{} {
+	phase := b.current()
+
+	statusText := phase.StatusText
+	if statusText == "" {
+		statusText = statusTexts[phase.Status]
+		if phase.Status == StatusRunning && phase.IsOnHold {
+			statusText = "on-hold"
+		}
+	}
+
+	var abortReason *string
+	if phase.AbortReason != "" {
+		abortReason = &phase.AbortReason
+	}
+
+	return map[string]interface{}{
+		"slug":                  b.slug,
+		"build_number":          b.number,
+		"status":                phase.Status,
+		"status_text":           statusText,
+		"is_on_hold":            phase.IsOnHold,
+		"abort_reason":          abortReason,
+		"triggered_at":          formatTime(&b.triggered),
+		"started_on_worker_at":  formatTime(b.startedAt),
+		"finished_at":           formatTime(b.finishedAt),
+		"triggered_workflow":    b.workflow,
+		"original_build_params": b.params,
+	}
+}
+
+// Pipeline, stage and pipeline workflow statuses
+const (
+	pipelineStatusPending   = "pending"
+	pipelineStatusRunning   = "running"
+	pipelineStatusSucceeded = "succeeded"
+	pipelineStatusFailed    = "failed"
+	pipelineStatusAborted   = "aborted"
+)
+
+// stageStatus returns the status of a started stage, based on its builds.
+func stageStatus(builds []*build) string {
+	status := pipelineStatusSucceeded
+	for _, b := range builds {
+		switch b.current().Status {
+		case StatusRunning:
+			return pipelineStatusRunning
+		case StatusError:
+			status = pipelineStatusFailed
+		case StatusAborted:
+			if status != pipelineStatusFailed {
+				status = pipelineStatusAborted
+			}
+		}
+	}
+	return status
+}
+
+func (p *pipeline) status() string {
+	if p.aborted {
+		return pipelineStatusAborted
+	}
+	for _, builds := range p.builds {
+		if status := stageStatus(builds); status != pipelineStatusSucceeded {
+			return status
+		}
+	}
+	if len(p.builds) < len(p.stages) {
+		return pipelineStatusRunning
+	}
+	return pipelineStatusSucceeded
+}
+
+func (p *pipeline) response() map[string]interface{} {
+	var stages []map[string]interface{}
+	for i, stage := range p.stages {
+		status := pipelineStatusPending
+		var builds []*build
+		if i < len(p.builds) {
+			builds = p.builds[i]
+			status = stageStatus(builds)
+		}
+
+		var workflows []map[string]interface{}
+		for j, workflow := range stage.Workflows {
+			id, workflowStatus := "", pipelineStatusPending
+			if builds != nil {
+				id, workflowStatus = builds[j].slug, statusTexts[builds[j].current().Status]
+			}
+			workflows = append(workflows, map[string]interface{}{
+				"id":     id,
+				"name":   workflow,
+				"status": workflowStatus,
+			})
+		}
+
+		stages = append(stages, map[string]interface{}{
+			"name":      stage.Name,
+			"status":    status,
+			"workflows": workflows,
+		})
+	}
+
+	return map[string]interface{}{
+		"id":     p.id,
+		"name":   p.name,
+		"status": p.status(),
+		"stages": stages,
+	}
+}
+
+var statusTexts = map[int]string{
+	StatusRunning:            "in-progress",
+	StatusSuccess:            "success",
+	StatusError:              "error",
+	StatusAborted:            "aborted",
+	StatusAbortedWithSuccess: "aborted-with-success",
+}
+
+func formatTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := t.UTC().Format(time.RFC3339Nano)
+	return &s
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	// The client may have gone away, there is nobody to report the error to.
+	_ = json.NewEncoder(w).Encode(v)
+}
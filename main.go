@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bitrise-io/go-steputils/v2/stepconf"
@@ -13,65 +16,372 @@ import (
 
 // Config ...
 type Config struct {
-	RepositoryURL   string `env:"repository_url,required"`
-	RepositoryOwner string `env:"repository_owner,required"`
-	TriggerToken    string `env:"trigger_token,required"`
-	APIToken        string `env:"api_token,required"`
-	AppSlug         string `env:"app_slug,required"`
-	StackID         string `env:"stack_id,required"`
-	MachineType     string `env:"machine_type,required"`
-	Workflow        string `env:"workflow,required"`
-	Envs            string `env:"envs"`
-	HangTimeoutSec  int    `env:"hang_timeout,required"`
-	HangWebhookURL  string `env:"hang_webhook,required"`
-	HangChannel     string `env:"hang_channel,required"`
+	RepositoryURL   string          `env:"repository_url,required"`
+	RepositoryOwner string          `env:"repository_owner,required"`
+	TriggerToken    stepconf.Secret `env:"trigger_token"`
+	APIToken        stepconf.Secret `env:"api_token,required"`
+	AppSlug         string          `env:"app_slug,required"`
+	StackID         string          `env:"stack_id"`
+	MachineType     string          `env:"machine_type"`
+	Workflow        string          `env:"workflow"`
+	Pipeline        string          `env:"pipeline"`
+	Envs            string          `env:"envs"`
+	SensitiveEnvs   string          `env:"sensitive_envs"`
+	BuildSlugs      string          `env:"build_slugs"`
+	Matrix          string          `env:"matrix"`
+	// Git parameters
+	Branch        string `env:"branch"`
+	BranchDest    string `env:"branch_dest"`
+	CommitHash    string `env:"commit_hash"`
+	Tag           string `env:"tag"`
+	CommitMessage string `env:"commit_message"`
+	// Pull request simulation
+	PullRequestID            int    `env:"pull_request_id"`
+	PullRequestRepositoryURL string `env:"pull_request_repository_url"`
+	PullRequestHeadBranch    string `env:"pull_request_head_branch"`
+	PullRequestMergeBranch   string `env:"pull_request_merge_branch"`
+	PullRequestForkOwner     string `env:"pull_request_fork_owner"`
+	// Hang detection
+	HangDetection           string `env:"hang_detection,opt[wall_clock,log_inactivity]"`
+	HangTimeoutSec          int    `env:"hang_timeout,required"`
+	LogInactivityTimeoutSec int    `env:"log_inactivity_timeout"`
+	QueueTimeoutSec         int    `env:"queue_timeout"`
+	// Slack notifications
+	HangWebhookURL        stepconf.Secret `env:"hang_webhook"`
+	HangChannel           string          `env:"hang_channel,required"`
+	SlackAPIToken         stepconf.Secret `env:"slack_api_token"`
+	MessageUsername       string          `env:"message_username"`
+	HangMessageTemplate   string          `env:"hang_message_template"`
+	QueueMessageTemplate  string          `env:"queue_message_template"`
+	ResultMessageTemplate string          `env:"result_message_template"`
+	// Run modes
+	DryRun            bool `env:"dry_run,opt[yes,no]"`
+	ReuseRunningBuild bool `env:"reuse_running_build,opt[yes,no]"`
+	// Resumable runs
+	StateFile string `env:"state_file"`
+	RunID     string `env:"run_id"`
+	// Results
+	ResultsFile string `env:"results_file"`
+	// Outcome policy
+	PassStatuses     string `env:"pass_statuses"`
+	NeutralStatuses  string `env:"neutral_statuses"`
+	SuccessThreshold string `env:"success_threshold"`
+	RequiredEntries  string `env:"required_entries"`
+	// Service endpoints
+	APIBaseURL  string `env:"api_base_url"`
+	AppBaseURL  string `env:"app_base_url"`
+	SlackAPIURL string `env:"slack_api_url"`
+	// HTTP transport
+	HTTPTimeoutSec    int             `env:"http_timeout"`
+	ProxyURL          stepconf.Secret `env:"proxy_url"`
+	CABundle          string          `env:"ca_bundle"`
+	ClientCertificate string          `env:"client_certificate"`
+	ClientKey         string          `env:"client_key"`
 }
 
 func main() {
-	if err := runController(); err != nil {
+	log.SetOutWriter(NewRedactingWriter(os.Stdout, secrets))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := runController(ctx); err != nil {
 		log.Errorf("%s", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
-func runController() error {
+func runController(ctx context.Context) error {
 	var conf Config
 	parser := stepconf.NewInputParser(env.NewRepository())
 	if err := parser.Parse(&conf); err != nil {
-		return err
+		return configError(err)
+	}
+	secrets.Add(string(conf.TriggerToken), string(conf.APIToken), string(conf.HangWebhookURL), string(conf.SlackAPIToken), string(conf.ProxyURL))
+
+	if err := setEndpoints(conf.APIBaseURL, conf.AppBaseURL, conf.SlackAPIURL); err != nil {
+		return configError(err)
 	}
-	stepconf.Print(conf)
+	if conf.HTTPTimeoutSec < 0 {
+		return configError(fmt.Errorf("http_timeout can't be negative"))
+	}
+	client, err := newHTTPClient(HTTPConfig{
+		Timeout:        time.Duration(conf.HTTPTimeoutSec) * time.Second,
+		ProxyURL:       string(conf.ProxyURL),
+		CABundlePath:   conf.CABundle,
+		ClientCertPath: conf.ClientCertificate,
+		ClientKeyPath:  conf.ClientKey,
+	})
+	if err != nil {
+		return configError(err)
+	}
+	httpClient = client
 
-	envs := map[string]string{
-		"GIT_REPOSITORY_URL": conf.RepositoryURL,
+	inputEnvs, err := parseEnvs(conf.Envs)
+	if err != nil {
+		return configError(fmt.Errorf("invalid envs: %s", err))
+	}
+	sensitiveEnvs := strings.FieldsFunc(conf.SensitiveEnvs, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+	for _, key := range sensitiveEnvs {
+		for _, env := range inputEnvs {
+			if env.MappedTo == strings.TrimSpace(key) {
+				secrets.Add(env.Value)
+			}
+		}
 	}
 
-	s := strings.Split(conf.Envs, "\n")
-	for _, e := range s {
-		if strings.TrimSpace(e) == "" {
-			continue
+	printedConf := conf
+	printedConf.Envs = secrets.Redact(conf.Envs)
+	stepconf.Print(printedConf)
+
+	var buildRefs []string
+	for _, buildRef := range strings.Split(conf.BuildSlugs, "\n") {
+		if strings.TrimSpace(buildRef) != "" {
+			buildRefs = append(buildRefs, buildRef)
 		}
+	}
+	attach := len(buildRefs) > 0
 
-		es := strings.Split(e, "=")
-		envs[es[0]] = es[1]
+	if conf.HangWebhookURL == "" && conf.SlackAPIToken == "" {
+		return configError(fmt.Errorf("either hang_webhook or slack_api_token is required"))
+	}
+
+	envs := []BuildParamsEnvironment{{
+		MappedTo: "GIT_REPOSITORY_URL",
+		Value:    conf.RepositoryURL,
+		IsExpand: true,
+	}}
+	for _, env := range inputEnvs {
+		envs = setEnv(envs, env)
 	}
 
 	key := Key{
-		Stack:       conf.StackID,
-		MachineType: conf.MachineType,
-		Workflow:    conf.Workflow,
-		ID:          fmt.Sprintf("%s [%s]", conf.StackID, conf.MachineType),
-		Envs:        envs,
-		RepoOwner:   conf.RepositoryOwner,
+		AppSlug:      conf.AppSlug,
+		Stack:        conf.StackID,
+		MachineType:  conf.MachineType,
+		Workflow:     conf.Workflow,
+		Pipeline:     conf.Pipeline,
+		Envs:         envs,
+		triggerToken: string(conf.TriggerToken),
+		RepoOwner:    conf.RepositoryOwner,
+		Git: GitParams{
+			Branch:        conf.Branch,
+			BranchDest:    conf.BranchDest,
+			CommitHash:    conf.CommitHash,
+			Tag:           conf.Tag,
+			CommitMessage: conf.CommitMessage,
+		},
+	}
+	if conf.PullRequestID != 0 {
+		pr := PullRequestParams{
+			ID:            conf.PullRequestID,
+			RepositoryURL: conf.PullRequestRepositoryURL,
+			HeadBranch:    conf.PullRequestHeadBranch,
+			MergeBranch:   conf.PullRequestMergeBranch,
+			ForkOwner:     conf.PullRequestForkOwner,
+		}
+		if err := pr.Validate(); err != nil {
+			return configError(err)
+		}
+		key.PullRequest = &pr
+	}
+
+	var keys []Key
+	if !attach {
+		matrix, err := parseMatrix(conf.Matrix)
+		if err != nil {
+			return configError(fmt.Errorf("invalid matrix: %s", err))
+		}
+		if keys, err = newKeys(key, matrix); err != nil {
+			return configError(err)
+		}
 	}
+
 	hangingBuildWarning := HangingBuildWarning{
-		Timeout:    time.Duration(conf.HangTimeoutSec) * time.Second,
-		WebhookURL: conf.HangWebhookURL,
-		Channel:    conf.HangChannel,
+		Mode:                 conf.HangDetection,
+		Timeout:              time.Duration(conf.HangTimeoutSec) * time.Second,
+		LogInactivityTimeout: time.Duration(conf.LogInactivityTimeoutSec) * time.Second,
+		QueueTimeout:         time.Duration(conf.QueueTimeoutSec) * time.Second,
+	}
+	if hangingBuildWarning.Mode == HangDetectionLogInactivity && hangingBuildWarning.LogInactivityTimeout <= 0 {
+		return configError(fmt.Errorf("log_inactivity_timeout is required for the %s hang detection", HangDetectionLogInactivity))
+	}
+
+	if conf.HangMessageTemplate == "" {
+		conf.HangMessageTemplate = defaultHangMessageTemplate
+	}
+	hangMessageTemplate, err := parseMessageTemplate("hang_message_template", conf.HangMessageTemplate)
+	if err != nil {
+		return configError(err)
+	}
+	if conf.QueueMessageTemplate == "" {
+		conf.QueueMessageTemplate = defaultQueueMessageTemplate
+	}
+	queueMessageTemplate, err := parseMessageTemplate("queue_message_template", conf.QueueMessageTemplate)
+	if err != nil {
+		return configError(err)
+	}
+	notifications := Notifications{
+		WebhookURL:           string(conf.HangWebhookURL),
+		APIToken:             string(conf.SlackAPIToken),
+		Channel:              conf.HangChannel,
+		Username:             conf.MessageUsername,
+		HangMessageTemplate:  hangMessageTemplate,
+		QueueMessageTemplate: queueMessageTemplate,
+	}
+	if conf.ResultMessageTemplate != "" {
+		if notifications.ResultMessageTemplate, err = parseMessageTemplate("result_message_template", conf.ResultMessageTemplate); err != nil {
+			return configError(err)
+		}
+	}
+
+	policy, err := NewOutcomePolicy(conf.PassStatuses, conf.NeutralStatuses)
+	if err != nil {
+		return configError(err)
+	}
+	if attach {
+		if strings.TrimSpace(conf.SuccessThreshold) != "" || strings.TrimSpace(conf.RequiredEntries) != "" {
+			return configError(fmt.Errorf("success_threshold and required_entries are not supported with build_slugs"))
+		}
+	} else if err := policy.SetQuorum(conf.SuccessThreshold, conf.RequiredEntries, keys); err != nil {
+		return configError(err)
 	}
-	if _, err := ExecuteWorkflows(conf.TriggerToken, conf.APIToken, conf.AppSlug, key, hangingBuildWarning); err != nil {
+
+	if attach {
+		buildInfos, err := AttachBuilds(ctx, string(conf.APIToken), conf.AppSlug, buildRefs, policy, hangingBuildWarning, notifications)
+		return exportResults(conf.ResultsFile, buildInfos, err)
+	}
+
+	if err := validateStacks(string(conf.APIToken), keys, conf.DryRun); err != nil {
 		return err
 	}
 
-	return nil
+	if conf.DryRun {
+		if err := DryRunWorkflows(keys); err != nil {
+			return configError(err)
+		}
+		return nil
+	}
+
+	var state *RunState
+	if conf.StateFile != "" {
+		if conf.RunID == "" {
+			return configError(fmt.Errorf("run_id is required when state_file is set"))
+		}
+		if state, err = LoadRunState(conf.StateFile, conf.RunID); err != nil {
+			return err
+		}
+	}
+
+	buildInfos, err := ExecuteWorkflows(ctx, string(conf.APIToken), keys, conf.ReuseRunningBuild, state, policy, hangingBuildWarning, notifications)
+	return exportResults(conf.ResultsFile, buildInfos, err)
+}
+
+// exportResults writes the results file (if set) of a finished run, and returns the run's error.
+// Failing to write the results file only fails runs which succeeded otherwise.
+func exportResults(path string, buildInfos map[string]BuildInfo, runErr error) error {
+	if path == "" || buildInfos == nil {
+		return runErr
+	}
+
+	if err := writeResults(path, buildInfos); err != nil {
+		if runErr != nil {
+			log.Errorf("%s", err)
+			return runErr
+		}
+		return err
+	}
+	log.Donef("Results written to %s", path)
+	return runErr
+}
+
+// newKeys creates a key for each matrix entry, falling back to the base key's fields.
+// Without matrix entries the base key is the only key.
+func newKeys(base Key, matrix []MatrixEntry) ([]Key, error) {
+	if len(matrix) == 0 {
+		matrix = []MatrixEntry{{}}
+	}
+
+	multiApp := false
+	for _, entry := range matrix {
+		if entry.AppSlug != "" && entry.AppSlug != base.AppSlug {
+			multiApp = true
+		}
+	}
+
+	var keys []Key
+	for _, entry := range matrix {
+		key := base
+		if entry.AppSlug != "" && entry.AppSlug != base.AppSlug {
+			key.AppSlug = entry.AppSlug
+			// The base trigger token belongs to an other app.
+			key.triggerToken = ""
+		}
+		if entry.TriggerTokenEnv != "" {
+			key.triggerToken = os.Getenv(entry.TriggerTokenEnv)
+			if key.triggerToken == "" {
+				return nil, fmt.Errorf("the trigger token env of app %s (%s) is not set", key.AppSlug, entry.TriggerTokenEnv)
+			}
+			secrets.Add(key.triggerToken)
+		}
+		if entry.StackID != "" {
+			key.Stack = entry.StackID
+		}
+		if entry.MachineType != "" {
+			key.MachineType = entry.MachineType
+		}
+		if entry.Workflow != "" || entry.Pipeline != "" {
+			key.Workflow = entry.Workflow
+			key.Pipeline = entry.Pipeline
+		}
+
+		if (key.Workflow == "") == (key.Pipeline == "") {
+			return nil, fmt.Errorf("exactly one of workflow or pipeline is required")
+		}
+		if key.Pipeline != "" {
+			// The pipeline's workflows run on the stacks and machine types set in the bitrise.yml.
+			key.Stack, key.MachineType = "", ""
+		} else if key.Stack == "" || key.MachineType == "" {
+			return nil, fmt.Errorf("stack_id and machine_type are required for workflows")
+		}
+
+		keys = append(keys, key)
+	}
+
+	// The workflow is only part of the IDs of workflow entries if they run different ones.
+	multiWorkflow := false
+	workflow := ""
+	for _, key := range keys {
+		if key.Pipeline != "" {
+			continue
+		}
+		if workflow != "" && key.Workflow != workflow {
+			multiWorkflow = true
+		}
+		workflow = key.Workflow
+	}
+
+	ids := map[string]bool{}
+	for i := range keys {
+		key := &keys[i]
+		// Pipeline entries are identified by the pipeline.
+		if key.Pipeline != "" {
+			key.ID = key.target()
+		} else {
+			key.ID = fmt.Sprintf("%s [%s]", key.Stack, key.MachineType)
+			if multiWorkflow {
+				key.ID = fmt.Sprintf("%s %s", key.ID, key.target())
+			}
+		}
+		if multiApp {
+			key.ID = fmt.Sprintf("%s %s", key.AppSlug, key.ID)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("duplicated matrix entry: %s", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	return keys, nil
 }
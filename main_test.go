@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewKeys(t *testing.T) {
+	base := Key{AppSlug: testAppSlug, Stack: "linux", MachineType: "standard", Workflow: "primary"}
+
+	for _, tc := range []struct {
+		name    string
+		matrix  []MatrixEntry
+		wantIDs []string
+	}{
+		{
+			name:    "single entry",
+			wantIDs: []string{"linux [standard]"},
+		},
+		{
+			name:    "same workflow",
+			matrix:  []MatrixEntry{{StackID: "linux"}, {StackID: "osx"}},
+			wantIDs: []string{"linux [standard]", "osx [standard]"},
+		},
+		{
+			name:    "different workflows",
+			matrix:  []MatrixEntry{{Workflow: "primary"}, {Workflow: "deploy"}},
+			wantIDs: []string{"linux [standard] primary", "linux [standard] deploy"},
+		},
+		{
+			name:    "pipelines",
+			matrix:  []MatrixEntry{{Workflow: "primary"}, {Pipeline: "release"}, {Pipeline: "nightly", StackID: "osx"}},
+			wantIDs: []string{"linux [standard]", "pipeline:release", "pipeline:nightly"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			keys, err := newKeys(base, tc.matrix)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(keys) != len(tc.wantIDs) {
+				t.Fatalf("expected %d keys, got %d", len(tc.wantIDs), len(keys))
+			}
+			for i, key := range keys {
+				if key.ID != tc.wantIDs[i] {
+					t.Errorf("expected ID %q, got %q", tc.wantIDs[i], key.ID)
+				}
+			}
+		})
+	}
+
+	if _, err := newKeys(base, []MatrixEntry{{StackID: "linux"}, {StackID: "linux"}}); err == nil {
+		t.Error("expected an error for duplicated entries")
+	}
+}
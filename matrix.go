@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatrixEntry is a line of the matrix input, empty fields fall back to the step's inputs.
+type MatrixEntry struct {
+	AppSlug string
+	// TriggerTokenEnv is the name of the env var holding the app's build trigger token.
+	TriggerTokenEnv string
+	StackID         string
+	MachineType     string
+	Workflow        string
+	Pipeline        string
+}
+
+// parseMatrix parses the matrix input.
+//
+// Each non-empty line is an entry of whitespace separated key=value fields, lines starting with # are comments:
+//
+//	app_slug=<slug> trigger_token_env=<ENV_NAME> stack_id=<stack> machine_type=<machine type> workflow=<workflow> pipeline=<pipeline>
+func parseMatrix(s string) ([]MatrixEntry, error) {
+	var entries []MatrixEntry
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var entry MatrixEntry
+		for _, field := range strings.Fields(line) {
+			idx := strings.Index(field, "=")
+			if idx == -1 {
+				return nil, fmt.Errorf("line %d: missing '=' in %q", i+1, field)
+			}
+
+			value := field[idx+1:]
+			switch key := field[:idx]; key {
+			case "app_slug":
+				entry.AppSlug = value
+			case "trigger_token_env":
+				entry.TriggerTokenEnv = value
+			case "stack_id":
+				entry.StackID = value
+			case "machine_type":
+				entry.MachineType = value
+			case "workflow":
+				entry.Workflow = value
+			case "pipeline":
+				entry.Pipeline = value
+			default:
+				return nil, fmt.Errorf("line %d: unknown field %q", i+1, key)
+			}
+		}
+
+		if entry.Workflow != "" && entry.Pipeline != "" {
+			return nil, fmt.Errorf("line %d: only one of workflow or pipeline can be set", i+1)
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
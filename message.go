@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"text/template"
 
 	"github.com/bitrise-io/go-utils/log"
 )
@@ -33,47 +34,116 @@ type Message struct {
 
 	// Username specifies the bot's username for the message.
 	Username string `json:"username,omitempty"`
+
+	// ThreadTS is the timestamp of the parent message, it makes the message a thread reply.
+	ThreadTS string `json:"thread_ts,omitempty"`
+
+	// TS is the timestamp of the message to update, only used by chat.update.
+	TS string `json:"ts,omitempty"`
+}
+
+// Notifications configures where and how the controller posts its Slack messages.
+// If APIToken is set the messages are posted with the bot token, otherwise to the WebhookURL.
+type Notifications struct {
+	WebhookURL string
+	APIToken   string
+	Channel    string
+	Username   string
+
+	HangMessageTemplate  *template.Template
+	QueueMessageTemplate *template.Template
+	// ResultMessageTemplate is optional, without it results are only reported in bot-token mode.
+	ResultMessageTemplate *template.Template
+}
+
+// MessageResponse is the response of the chat.postMessage Web API method.
+// Slack responds with HTTP 200 even if the request failed, the outcome is reported by the OK and Error fields.
+type MessageResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// Channel is the encoded ID of the channel the message was posted to.
+	Channel string `json:"channel,omitempty"`
+
+	// TS is the timestamp of the posted message, it identifies the message for threading or updates.
+	TS string `json:"ts,omitempty"`
 }
 
 // postMessage sends a message to a channel.
-func postMessage(msg Message, apiToken, webhookURL string) error {
+//
+// If apiToken is set the message is sent through the chat.postMessage Web API method (bot-token mode),
+// otherwise it is sent to the incoming webhook.
+// The returned response is only filled in bot-token mode, webhooks don't report the posted message.
+func postMessage(msg Message, apiToken, webhookURL string) (MessageResponse, error) {
+	msg.Text = secrets.Redact(msg.Text)
 	b, err := json.Marshal(msg)
 	if err != nil {
-		return err
+		return MessageResponse{}, err
 	}
 	log.Debugf("Request to Slack: %s\n", b)
 
 	url := strings.TrimSpace(webhookURL)
-	if url == "" {
-		url = "https://slack.com/api/chat.postMessage"
+	if apiToken != "" || url == "" {
+		url = slackAPIURL + "/chat.postMessage"
+	}
+
+	return sendMessage(b, apiToken, url)
+}
+
+// updateMessage edits a message previously posted in bot-token mode.
+// The message is identified by its Channel ID and TS.
+func updateMessage(msg Message, apiToken string) (MessageResponse, error) {
+	msg.Text = secrets.Redact(msg.Text)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return MessageResponse{}, err
 	}
+	log.Debugf("Update request to Slack: %s\n", b)
 
+	return sendMessage(b, apiToken, slackAPIURL+"/chat.update")
+}
+
+func sendMessage(b []byte, apiToken, url string) (MessageResponse, error) {
 	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return MessageResponse{}, fmt.Errorf("failed to create the request: %s", err)
+	}
 	req.Header.Add("Content-Type", "application/json; charset=utf-8")
 
-	if string(apiToken) != "" {
-		req.Header.Add("Authorization", "Bearer "+string(apiToken))
+	if apiToken != "" {
+		req.Header.Add("Authorization", "Bearer "+apiToken)
 	}
 
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send the request: %s", err)
+		return MessageResponse{}, fmt.Errorf("failed to send the request: %s", err)
 	}
 	defer func() {
-		if cerr := resp.Body.Close(); err == nil {
-			err = cerr
+		if cerr := resp.Body.Close(); cerr != nil {
+			log.Warnf("Failed to close response body: %s", cerr)
 		}
 	}()
 
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return MessageResponse{}, fmt.Errorf("server error: %s, failed to read response: %s", resp.Status, err)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("server error: %s, failed to read response: %s", resp.Status, err)
-		}
-		return fmt.Errorf("server error: %s, response: %s", resp.Status, body)
+		return MessageResponse{}, fmt.Errorf("server error: %s, response: %s", resp.Status, body)
+	}
+
+	if apiToken == "" {
+		return MessageResponse{}, nil
+	}
+
+	var response MessageResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return MessageResponse{}, fmt.Errorf("failed to unmarshal response (%s): %s", body, err)
+	}
+	if !response.OK {
+		return MessageResponse{}, fmt.Errorf("slack error: %s", response.Error)
 	}
 
-	return nil
+	return response, nil
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Outcomes of a finished build
+const (
+	// OutcomePass ...
+	OutcomePass = "pass"
+	// OutcomeFail ...
+	OutcomeFail = "fail"
+	// OutcomeNeutral builds neither fail the run, nor count as passed.
+	OutcomeNeutral = "neutral"
+)
+
+// Exit codes
+const (
+	exitCodeSomeFailed  = 1
+	exitCodeInfraError  = 2
+	exitCodeTimedOut    = 3
+	exitCodeConfigError = 4
+	// exitCodeInterrupted follows the shell convention for processes terminated by SIGINT.
+	exitCodeInterrupted = 130
+)
+
+// OutcomePolicy decides which final build statuses pass, fail or are neutral,
+// and whether the run succeeds based on the outcomes of its entries.
+// StatusFinishedWithSuccess always passes, statuses not listed fail.
+//
+// Without a success threshold every entry has to pass (or be neutral), and the first failure aborts the others.
+type OutcomePolicy struct {
+	PassStatuses    []string
+	NeutralStatuses []string
+	// SuccessThreshold is the minimum number (or percentage) of passing entries, failures of not required entries
+	// are tolerated as long as it can be met.
+	SuccessThreshold SuccessThreshold
+	// RequiredEntries are the IDs of the entries which must always pass.
+	RequiredEntries []string
+}
+
+// NewOutcomePolicy parses the comma or newline separated status lists of the policy.
+func NewOutcomePolicy(passStatuses, neutralStatuses string) (OutcomePolicy, error) {
+	policy := OutcomePolicy{
+		PassStatuses:    splitStatuses(passStatuses),
+		NeutralStatuses: splitStatuses(neutralStatuses),
+	}
+
+	seen := map[string]string{}
+	for _, list := range []struct {
+		name     string
+		statuses []string
+	}{
+		{"pass_statuses", policy.PassStatuses},
+		{"neutral_statuses", policy.NeutralStatuses},
+	} {
+		for _, status := range list.statuses {
+			if !isFinalState(status) && status != StatusUnknown {
+				return OutcomePolicy{}, fmt.Errorf("invalid %s: %s is not a final build status", list.name, status)
+			}
+			if other, ok := seen[status]; ok {
+				return OutcomePolicy{}, fmt.Errorf("invalid %s: %s is already listed in %s", list.name, status, other)
+			}
+			seen[status] = list.name
+		}
+	}
+
+	return policy, nil
+}
+
+func splitStatuses(s string) []string {
+	var statuses []string
+	for _, status := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == ','
+	}) {
+		if status = strings.TrimSpace(status); status != "" {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// SuccessThreshold is the minimum number of passing entries, given either as a count or as a percentage.
+// The zero value disables the threshold.
+type SuccessThreshold struct {
+	Count      int
+	Percentage float64
+}
+
+// Enabled ...
+func (t SuccessThreshold) Enabled() bool {
+	return t.Count > 0 || t.Percentage > 0
+}
+
+func (t SuccessThreshold) String() string {
+	if t.Percentage > 0 {
+		return strconv.FormatFloat(t.Percentage, 'f', -1, 64) + "%"
+	}
+	return strconv.Itoa(t.Count)
+}
+
+// parseSuccessThreshold parses a percentage (like 80%) or a count (like 3) of passing entries.
+func parseSuccessThreshold(s string) (SuccessThreshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return SuccessThreshold{}, nil
+	}
+
+	if strings.HasSuffix(s, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return SuccessThreshold{}, fmt.Errorf("invalid success_threshold: %s is not a percentage between 0 and 100", s)
+		}
+		return SuccessThreshold{Percentage: percentage}, nil
+	}
+
+	count, err := strconv.Atoi(s)
+	if err != nil || count <= 0 {
+		return SuccessThreshold{}, fmt.Errorf("invalid success_threshold: %s is neither a positive count nor a percentage", s)
+	}
+	return SuccessThreshold{Count: count}, nil
+}
+
+// SetQuorum sets the success threshold and the required entries of the policy, validating them against the run's entries.
+func (p *OutcomePolicy) SetQuorum(successThreshold, requiredEntries string, keys []Key) error {
+	threshold, err := parseSuccessThreshold(successThreshold)
+	if err != nil {
+		return err
+	}
+	if threshold.Count > len(keys) {
+		return fmt.Errorf("invalid success_threshold: %d is more than the number of entries (%d)", threshold.Count, len(keys))
+	}
+
+	ids := map[string]bool{}
+	for _, key := range keys {
+		ids[key.ID] = true
+	}
+
+	var required []string
+	for _, id := range strings.Split(requiredEntries, "\n") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if !ids[id] {
+			return fmt.Errorf("invalid required_entries: unknown entry %q", id)
+		}
+		required = append(required, id)
+	}
+
+	p.SuccessThreshold = threshold
+	p.RequiredEntries = required
+	return nil
+}
+
+// Tolerates reports whether a failure of the entry can be tolerated, without failing the run right away.
+func (p OutcomePolicy) Tolerates(id string) bool {
+	if !p.SuccessThreshold.Enabled() {
+		return false
+	}
+	for _, required := range p.RequiredEntries {
+		if required == id {
+			return false
+		}
+	}
+	return true
+}
+
+// Outcome returns the outcome of a build finished with the given status.
+func (p OutcomePolicy) Outcome(status string) string {
+	if status == StatusFinishedWithSuccess {
+		return OutcomePass
+	}
+	for _, s := range p.PassStatuses {
+		if s == status {
+			return OutcomePass
+		}
+	}
+	for _, s := range p.NeutralStatuses {
+		if s == status {
+			return OutcomeNeutral
+		}
+	}
+	return OutcomeFail
+}
+
+// Evaluate checks the outcomes of the entries (by entry ID) against the required entries and the success threshold.
+// Neutral entries don't count in the percentage based threshold.
+func (p OutcomePolicy) Evaluate(outcomes map[string]string) error {
+	if !p.SuccessThreshold.Enabled() {
+		return nil
+	}
+
+	for _, id := range p.RequiredEntries {
+		if outcome := outcomes[id]; outcome != OutcomePass {
+			return withExitCode(exitCodeSomeFailed, fmt.Errorf("[%s] required entry did not pass (%s)", id, outcome))
+		}
+	}
+
+	passed, counted := 0, 0
+	var failed []string
+	for id, outcome := range outcomes {
+		switch outcome {
+		case OutcomePass:
+			passed++
+			counted++
+		case OutcomeFail:
+			counted++
+			failed = append(failed, id)
+		}
+	}
+	sort.Strings(failed)
+
+	met := passed >= p.SuccessThreshold.Count
+	if p.SuccessThreshold.Percentage > 0 {
+		met = counted > 0 && float64(passed)*100/float64(counted) >= p.SuccessThreshold.Percentage
+	}
+	if !met {
+		return withExitCode(exitCodeSomeFailed, fmt.Errorf("success threshold (%s) is not met: %d of %d entries passed, failed: %s", p.SuccessThreshold, passed, counted, strings.Join(failed, ", ")))
+	}
+
+	if len(failed) > 0 {
+		log.Warnf("Tolerated failures: %s", strings.Join(failed, ", "))
+	}
+	log.Donef("Success threshold (%s) is met: %d of %d entries passed", p.SuccessThreshold, passed, counted)
+	return nil
+}
+
+// exitError is an error mapped to the process exit code of the run.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitError) Unwrap() error {
+	return e.err
+}
+
+func withExitCode(code int, err error) error {
+	return exitError{code: code, err: err}
+}
+
+func configError(err error) error {
+	return withExitCode(exitCodeConfigError, err)
+}
+
+// exitCode returns the process exit code of a run failed with err.
+// Errors not mapped to an exit code (like failing API calls) are infrastructure errors.
+func exitCode(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return exitCodeInterrupted
+	}
+
+	var exitErr exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitCodeInfraError
+}
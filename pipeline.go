@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/colorstring"
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Pipeline statuses
+const (
+	// PipelineStatusInitializing ...
+	PipelineStatusInitializing = "initializing"
+	// PipelineStatusOnHold ...
+	PipelineStatusOnHold = "on_hold"
+	// PipelineStatusRunning ...
+	PipelineStatusRunning = "running"
+	// PipelineStatusSucceeded ...
+	PipelineStatusSucceeded = "succeeded"
+	// PipelineStatusSucceededWithAbort ...
+	PipelineStatusSucceededWithAbort = "succeeded_with_abort"
+	// PipelineStatusFailed ...
+	PipelineStatusFailed = "failed"
+	// PipelineStatusAborted ...
+	PipelineStatusAborted = "aborted"
+)
+
+// PipelineWorkflow ...
+type PipelineWorkflow struct {
+	// ID is the slug of the workflow's build, empty until the build is started.
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// PipelineStage ...
+type PipelineStage struct {
+	Name      string             `json:"name"`
+	Status    string             `json:"status"`
+	Workflows []PipelineWorkflow `json:"workflows"`
+}
+
+// Pipeline ...
+type Pipeline struct {
+	ID     string          `json:"id"`
+	Name   string          `json:"name"`
+	Status string          `json:"status"`
+	Stages []PipelineStage `json:"stages"`
+}
+
+func isPipelineRunning(status string) bool {
+	switch status {
+	case PipelineStatusInitializing, PipelineStatusOnHold, PipelineStatusRunning:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipelineBuildStatus maps a pipeline status to the equivalent build status, so the outcome policy applies to pipelines too.
+func pipelineBuildStatus(status string) string {
+	switch status {
+	case PipelineStatusSucceeded:
+		return StatusFinishedWithSuccess
+	case PipelineStatusSucceededWithAbort:
+		return StatusAbortedWithSuccess
+	case PipelineStatusFailed:
+		return StatusFinishedWithError
+	case PipelineStatusAborted:
+		return StatusAborted
+	case PipelineStatusInitializing, PipelineStatusOnHold, PipelineStatusRunning:
+		return StatusInProgress
+	default:
+		return StatusUnknown
+	}
+}
+
+func pipelineURL(appSlug, pipelineID string) string {
+	return appBaseURL + "/app/" + appSlug + "/pipelines/" + pipelineID
+}
+
+// pollPipeline monitors a triggered pipeline until it finishes.
+//
+// Every workflow of the pipeline is a separate build, once a workflow's build is started it is monitored by pollBuild
+// (with the same hang detection and notifications as a single workflow build).
+// The returned build infos have a row for each workflow, grouped by their stage,
+// the returned status is the last polled status of the pipeline.
+// If ctx is canceled, the pipeline is aborted with the reason returned by abortReason, so its not yet started stages don't run.
+// If the pipeline can't be aborted, its workflow builds still running are aborted one by one.
+func pollPipeline(ctx context.Context, apiToken string, appSlug string, pipelineID string, key Key, hangingBuildWarning HangingBuildWarning, runLog *RunLog, abortReason func() string) (map[string]BuildInfo, string) {
+	var buildInfos = map[string]BuildInfo{}
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+
+	monitored := map[string]bool{}
+	stageStatuses := map[string]string{}
+	lastStatus := ""
+
+	// unfinished holds the workflow builds still running when ctx was canceled, by build slug.
+	unfinished := map[string]MessageData{}
+	abortPipelineRun := func() (map[string]BuildInfo, string) {
+		wg.Wait()
+
+		reason := abortReason()
+		aborted := false
+		if lastStatus == "" || isPipelineRunning(lastStatus) {
+			var message string
+			message, aborted = abortPipeline(context.Background(), apiToken, appSlug, pipelineID, key.ID, reason)
+			log.Warnf(message)
+			runLog.Post(message)
+		}
+
+		for buildSlug, result := range unfinished {
+			buildInfo := result.BuildInfo
+			if aborted {
+				buildInfo.markAbortedByController(reason)
+			} else {
+				message, buildAborted := abortBuilds(context.Background(), apiToken, appSlug, buildSlug, result.Key.ID, reason)
+				if buildAborted {
+					buildInfo.markAbortedByController(reason)
+				}
+				log.Warnf(message)
+				runLog.Post(message)
+			}
+			result.BuildInfo = buildInfo
+			runLog.NotifyResult(result)
+			buildInfos[result.Key.ID] = buildInfo
+		}
+
+		if aborted {
+			return buildInfos, PipelineStatusAborted
+		}
+		return buildInfos, lastStatus
+	}
+
+	for {
+		pipeline, err := GetPipeline(apiToken, appSlug, pipelineID)
+		if err != nil {
+			fmt.Println()
+			log.Errorf("[%s] Failed to get pipeline: %s", key.ID, err)
+			runLog.Post("[%s] Failed to get pipeline, retrying: %s", key.ID, err)
+			select {
+			case <-ctx.Done():
+				return abortPipelineRun()
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		if pipeline.Status != lastStatus {
+			runLog.Post("[%s] Pipeline status: %s", key.ID, pipeline.Status)
+			lastStatus = pipeline.Status
+		}
+
+		for stageIndex, stage := range pipeline.Stages {
+			if stage.Status != stageStatuses[stage.Name] {
+				runLog.Post("[%s] Stage %s: %s", key.ID, stage.Name, stage.Status)
+				stageStatuses[stage.Name] = stage.Status
+			}
+
+			for _, workflow := range stage.Workflows {
+				if workflow.ID == "" || monitored[workflow.ID] {
+					continue
+				}
+				monitored[workflow.ID] = true
+
+				workflowKey := pipelineWorkflowKey(key, stage, workflow)
+				wg.Add(1)
+				go func(stageIndex int, stageName, buildSlug string) {
+					defer wg.Done()
+					result, err := pollBuild(ctx, apiToken, appSlug, buildSlug, workflowKey, hangingBuildWarning, runLog)
+					buildInfo := result.BuildInfo
+					buildInfo.Stage = stageName
+					buildInfo.stageIndex = stageIndex
+					result.BuildInfo = buildInfo
+
+					if !isFinalState(buildInfo.RawStatus) && err == nil {
+						// ctx is canceled, the build is aborted together with the pipeline.
+						mux.Lock()
+						unfinished[buildSlug] = result
+						mux.Unlock()
+						return
+					}
+					if buildInfo.RawStatus == StatusUnknown {
+						message, aborted := abortBuilds(context.Background(), apiToken, appSlug, buildSlug, workflowKey.ID, abortReasonUnknownStatus)
+						if aborted {
+							buildInfo.markAbortedByController(abortReasonUnknownStatus)
+						}
+						log.Warnf(message)
+						runLog.Post(message)
+						result.BuildInfo = buildInfo
+					}
+					runLog.NotifyResult(result)
+
+					mux.Lock()
+					buildInfos[workflowKey.ID] = buildInfo
+					mux.Unlock()
+				}(stageIndex, stage.Name, workflow.ID)
+			}
+		}
+
+		if isPipelineRunning(pipeline.Status) {
+			select {
+			case <-ctx.Done():
+				return abortPipelineRun()
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		wg.Wait()
+
+		// Workflows without a build (for example skipped ones) get their row from the pipeline.
+		for stageIndex, stage := range pipeline.Stages {
+			for _, workflow := range stage.Workflows {
+				if workflow.ID != "" {
+					continue
+				}
+
+				workflowKey := pipelineWorkflowKey(key, stage, workflow)
+				buildInfos[workflowKey.ID] = BuildInfo{
+					Status:     colorstring.NoColor(workflow.Status),
+					RawStatus:  workflow.Status,
+					URL:        pipelineURL(appSlug, pipelineID),
+					ID:         workflowKey.ID,
+					Duration:   "-",
+					Stage:      stage.Name,
+					stageIndex: stageIndex,
+				}
+			}
+		}
+
+		return buildInfos, pipeline.Status
+	}
+}
+
+func pipelineWorkflowKey(key Key, stage PipelineStage, workflow PipelineWorkflow) Key {
+	workflowKey := key
+	workflowKey.ID = fmt.Sprintf("%s / %s / %s", key.ID, stage.Name, workflow.Name)
+	workflowKey.Workflow = workflow.Name
+	return workflowKey
+}
+
+// abortPipeline aborts a pipeline (and its running workflow builds) on behalf of the controller,
+// it returns the message describing the result and whether the pipeline was aborted.
+// The abort request times out after abortTimeout, or earlier if ctx has an earlier deadline.
+func abortPipeline(ctx context.Context, apiToken string, appSlug string, pipelineID string, id string, reason string) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, abortTimeout)
+	defer cancel()
+
+	if err := AbortPipeline(ctx, apiToken, appSlug, pipelineID, controllerAbortPrefix+reason); err != nil {
+		return fmt.Sprintf("[%s] Failed to abort pipeline: %s", id, strings.TrimSpace(err.Error())), false
+	}
+	return fmt.Sprintf("[%s] Pipeline aborted: %s", id, reason), true
+}
+
+// GetPipeline ...
+func GetPipeline(personalAccessToken, appSlug, pipelineID string) (Pipeline, error) {
+	url := fmt.Sprintf("%s/apps/%s/pipelines/%s", baseURL, appSlug, pipelineID)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("failed to construct get pipeline request (URL: %s): %s", url, err)
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
+	req.Header.Add("Content-type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Pipeline{}, err
+	}
+
+	defer func() {
+		cErr := resp.Body.Close()
+		if cErr != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Pipeline{}, fmt.Errorf("failed to read get pipeline request response: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return Pipeline{}, fmt.Errorf("HTTP response code (%d %s) not 200, response: %s", resp.StatusCode, resp.Status, data)
+	}
+
+	var pipeline Pipeline
+	if err := json.Unmarshal(data, &pipeline); err != nil {
+		return Pipeline{}, fmt.Errorf("failed to unmarshal get pipeline response: %s", err)
+	}
+
+	return pipeline, nil
+}
+
+// AbortPipeline ...
+func AbortPipeline(ctx context.Context, personalAccessToken, appSlug, pipelineID, reason string) error {
+	url := fmt.Sprintf("%s/apps/%s/pipelines/%s/abort", baseURL, appSlug, pipelineID)
+
+	body, err := json.Marshal(BuildAbortParams{AbortReason: reason})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to construct abort pipeline request (URL: %s): %s", url, err)
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
+	req.Header.Add("Content-type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		cErr := resp.Body.Close()
+		if cErr != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read abort pipeline request response: %s", err)
+	}
+
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return fmt.Errorf("HTTP response code (%d %s) not 200, response: %s", resp.StatusCode, resp.Status, data)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	redactedValue = "[REDACTED]"
+	// minSecretLength prevents masking every occurrence of short, common values (like "1" or "yes").
+	minSecretLength = 4
+)
+
+// Redactor masks secret values in text.
+type Redactor struct {
+	mux     sync.RWMutex
+	secrets []string
+}
+
+// secrets masks the secrets in every log line, report and notification of the controller.
+var secrets = &Redactor{}
+
+// Add registers secret values, values shorter than minSecretLength are ignored.
+func (r *Redactor) Add(values ...string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		r.secrets = append(r.secrets, value)
+	}
+	// Longer secrets first, so a secret containing an other one is masked as a whole.
+	sort.Slice(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+// Redact returns s with every registered secret masked.
+func (r *Redactor) Redact(s string) string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redactedValue)
+	}
+	return s
+}
+
+type redactingWriter struct {
+	writer   io.Writer
+	redactor *Redactor
+}
+
+// NewRedactingWriter returns a writer which masks the secrets before writing to w.
+// Each Write is expected to hold complete lines (as the log package writes them).
+func NewRedactingWriter(w io.Writer, r *Redactor) io.Writer {
+	return redactingWriter{
+		writer:   w,
+		redactor: r,
+	}
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.writer, w.redactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Results is the JSON document written to the results file.
+type Results struct {
+	Builds []BuildInfo `json:"builds"`
+}
+
+// writeResults writes the build infos of a run to path, in the same order as the results table.
+func writeResults(path string, buildInfos map[string]BuildInfo) error {
+	results := Results{Builds: sortedBuildInfos(buildInfos)}
+	if results.Builds == nil {
+		results.Builds = []BuildInfo{}
+	}
+
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal results: %s", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write results file: %s", err)
+	}
+	return nil
+}
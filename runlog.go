@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// RunLog posts the Slack notifications of a single controller run.
+//
+// In bot-token mode the run is logged as a thread: the parent message lists the triggered builds
+// and gets updated with the final verdict, every other event is posted as a thread reply under it.
+// The webhook API can't thread or edit messages, so in webhook mode only the notifications
+// (hang warnings and, if a result template is configured, results) are posted.
+type RunLog struct {
+	notifications Notifications
+
+	mux    sync.Mutex
+	parent MessageResponse
+	header string
+}
+
+// NewRunLog ...
+func NewRunLog(notifications Notifications) *RunLog {
+	if notifications.APIToken != "" && notifications.ResultMessageTemplate == nil {
+		notifications.ResultMessageTemplate = template.Must(parseMessageTemplate("result_message_template", defaultResultMessageTemplate))
+	}
+
+	return &RunLog{
+		notifications: notifications,
+	}
+}
+
+// Enabled reports whether the run log is threaded (bot-token mode).
+func (l *RunLog) Enabled() bool {
+	return l != nil && l.notifications.APIToken != ""
+}
+
+// Start posts the parent message listing the triggered builds.
+func (l *RunLog) Start(builds []buildKey) {
+	if !l.Enabled() {
+		return
+	}
+
+	lines := []string{"*Controller run started*"}
+	for _, build := range builds {
+		lines = append(lines, fmt.Sprintf("• %s: <%s|%s>", build.key.ID, build.url(), build.triggerResult.BuildSlug))
+	}
+	header := strings.Join(lines, "\n")
+
+	resp, err := postMessage(Message{
+		Channel:  l.notifications.Channel,
+		Text:     header,
+		Username: l.notifications.Username,
+	}, l.notifications.APIToken, "")
+	if err != nil {
+		log.Warnf("Failed to post run log message: %s", err)
+		return
+	}
+
+	l.mux.Lock()
+	l.parent = resp
+	l.header = header
+	l.mux.Unlock()
+}
+
+// Post sends a thread reply under the parent message, it is a no-op in webhook mode.
+func (l *RunLog) Post(format string, v ...interface{}) {
+	if !l.Enabled() {
+		return
+	}
+
+	l.mux.Lock()
+	parent := l.parent
+	l.mux.Unlock()
+	if parent.TS == "" {
+		return
+	}
+
+	if _, err := postMessage(Message{
+		Channel:  parent.Channel,
+		Text:     fmt.Sprintf(format, v...),
+		Username: l.notifications.Username,
+		ThreadTS: parent.TS,
+	}, l.notifications.APIToken, ""); err != nil {
+		log.Warnf("Failed to post run log reply: %s", err)
+	}
+}
+
+// NotifyHang posts the hang warning of a build.
+func (l *RunLog) NotifyHang(data MessageData) {
+	text, err := renderMessage(l.notifications.HangMessageTemplate, data)
+	if err != nil {
+		log.Errorf("Failed to warn about potentially hanging build: %s", err)
+		return
+	}
+
+	if err := l.notify(text); err != nil {
+		log.Errorf("Failed to warn about potentially hanging build: %s", err)
+	}
+}
+
+// NotifyQueued posts the warning about a build waiting too long for a worker.
+func (l *RunLog) NotifyQueued(data MessageData) {
+	text, err := renderMessage(l.notifications.QueueMessageTemplate, data)
+	if err != nil {
+		log.Errorf("Failed to warn about queued build: %s", err)
+		return
+	}
+
+	if err := l.notify(text); err != nil {
+		log.Errorf("Failed to warn about queued build: %s", err)
+	}
+}
+
+// NotifyResult posts the final result of a build.
+func (l *RunLog) NotifyResult(data MessageData) {
+	tmpl := l.notifications.ResultMessageTemplate
+	if tmpl == nil {
+		return
+	}
+
+	text, err := renderMessage(tmpl, data)
+	if err != nil {
+		log.Errorf("Failed to report build result: %s", err)
+		return
+	}
+
+	if err := l.notify(text); err != nil {
+		log.Errorf("Failed to report build result: %s", err)
+	}
+}
+
+// notify posts a thread reply in bot-token mode, or a message to the webhook otherwise.
+func (l *RunLog) notify(text string) error {
+	if l.Enabled() {
+		l.Post("%s", text)
+		return nil
+	}
+
+	_, err := postMessage(Message{
+		Channel:  l.notifications.Channel,
+		Text:     text,
+		Username: l.notifications.Username,
+	}, "", l.notifications.WebhookURL)
+	return err
+}
+
+// Finish edits the parent message to show the final verdict.
+func (l *RunLog) Finish(runErr error) {
+	if !l.Enabled() {
+		return
+	}
+
+	verdict := ":white_check_mark: *Succeeded*"
+	if runErr != nil {
+		verdict = fmt.Sprintf(":x: *Failed*: %s", runErr)
+	}
+
+	l.mux.Lock()
+	parent := l.parent
+	header := l.header
+	l.mux.Unlock()
+	if parent.TS == "" {
+		return
+	}
+
+	if _, err := updateMessage(Message{
+		Channel: parent.Channel,
+		Text:    header + "\n" + verdict,
+		TS:      parent.TS,
+	}, l.notifications.APIToken); err != nil {
+		log.Warnf("Failed to update run log message: %s", err)
+	}
+}
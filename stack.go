@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// AvailableOption is a stack or machine type available to an app.
+type AvailableOption struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// validateStacks checks the stack and machine type of every workflow key against the ones available to its app,
+// so a typo fails before anything is triggered (instead of as an obscure trigger error, or as a build running on an other stack).
+//
+// If the available stacks or machine types of an app can't be listed, the app's keys are skipped with a warning,
+// in strict mode (dry run) it is an error.
+// Unavailable stacks and machine types are config errors.
+func validateStacks(apiToken string, keys []Key, strict bool) error {
+	fmt.Println()
+	log.Infof("Validating stacks and machine types")
+
+	// apps holds the availability of each app, nil if it couldn't be listed.
+	apps := map[string]*availability{}
+	skipped := false
+
+	for _, key := range keys {
+		if key.Pipeline != "" {
+			// The pipeline's workflows run on the stacks and machine types set in the bitrise.yml.
+			continue
+		}
+
+		available, ok := apps[key.AppSlug]
+		if !ok {
+			var err error
+			if available, err = getAvailability(apiToken, key.AppSlug); err != nil {
+				if strict {
+					return err
+				}
+				log.Warnf("Skipping the validation of app %s, %s", key.AppSlug, err)
+				skipped = true
+			}
+			apps[key.AppSlug] = available
+		}
+		if available == nil {
+			continue
+		}
+
+		if err := validateOption("stack", key.Stack, available.stacks); err != nil {
+			return configError(fmt.Errorf("[%s] %s", key.ID, err))
+		}
+		if err := validateOption("machine type", key.MachineType, available.machineTypes); err != nil {
+			return configError(fmt.Errorf("[%s] %s", key.ID, err))
+		}
+	}
+
+	if skipped {
+		log.Warnf("Stacks and machine types are only partially validated")
+		return nil
+	}
+	log.Donef("Stacks and machine types are available")
+	return nil
+}
+
+// availability holds the IDs of the stacks and machine types available to an app.
+type availability struct {
+	stacks       []string
+	machineTypes []string
+}
+
+func getAvailability(apiToken, appSlug string) (*availability, error) {
+	stacks, err := GetStacks(apiToken, appSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the stacks of app %s: %s", appSlug, err)
+	}
+	machineTypes, err := GetMachineTypes(apiToken, appSlug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the machine types of app %s: %s", appSlug, err)
+	}
+
+	return &availability{
+		stacks:       optionIDs(stacks),
+		machineTypes: optionIDs(machineTypes),
+	}, nil
+}
+
+func optionIDs(options []AvailableOption) []string {
+	var ids []string
+	for _, option := range options {
+		ids = append(ids, option.ID)
+	}
+	return ids
+}
+
+// validateOption returns an error if value is not available, suggesting the closest available value.
+func validateOption(name, value string, available []string) error {
+	for _, option := range available {
+		if option == value {
+			return nil
+		}
+	}
+
+	if suggestion := closestMatch(value, available); suggestion != "" {
+		return fmt.Errorf("%s %s is not available, did you mean %s?", name, value, suggestion)
+	}
+	return fmt.Errorf("%s %s is not available, available values: %s", name, value, strings.Join(available, ", "))
+}
+
+// closestMatch returns the option with the smallest edit distance to value,
+// or an empty string if none of them is close enough to be a likely typo.
+func closestMatch(value string, options []string) string {
+	maxDistance := len(value)/3 + 1
+
+	match := ""
+	matchDistance := maxDistance + 1
+	for _, option := range options {
+		if distance := levenshtein(strings.ToLower(value), strings.ToLower(option)); distance < matchDistance {
+			match = option
+			matchDistance = distance
+		}
+	}
+	return match
+}
+
+// levenshtein returns the minimum number of single character edits turning a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
+
+// GetStacks ...
+func GetStacks(personalAccessToken, appSlug string) ([]AvailableOption, error) {
+	return getAvailableOptions(personalAccessToken, fmt.Sprintf("%s/apps/%s/stacks", baseURL, appSlug))
+}
+
+// GetMachineTypes ...
+func GetMachineTypes(personalAccessToken, appSlug string) ([]AvailableOption, error) {
+	return getAvailableOptions(personalAccessToken, fmt.Sprintf("%s/apps/%s/machine-types", baseURL, appSlug))
+}
+
+func getAvailableOptions(personalAccessToken, url string) ([]AvailableOption, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct request (URL: %s): %s", url, err)
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
+	req.Header.Add("Content-type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		cErr := resp.Body.Close()
+		if cErr != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP response code (%d %s) not 200, response: %s", resp.StatusCode, resp.Status, data)
+	}
+
+	m := struct {
+		Data []AvailableOption `json:"data"`
+	}{}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %s", err)
+	}
+
+	return m.Data, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateStacks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apps/listed/stacks":
+			_, _ = w.Write([]byte(`{"data":[{"id":"linux-docker-android-22.04"}]}`))
+		case "/apps/listed/machine-types":
+			_, _ = w.Write([]byte(`{"data":[{"id":"standard"}]}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	origBaseURL := baseURL
+	baseURL = server.URL
+	defer func() { baseURL = origBaseURL }()
+
+	unlisted := Key{ID: "unlisted", AppSlug: "unlisted", Stack: "linux-docker-android-22.04", MachineType: "standard"}
+	typo := Key{ID: "typo", AppSlug: "listed", Stack: "linux-docker-android-20.04", MachineType: "standard"}
+
+	err := validateStacks("api-token", []Key{unlisted, typo}, false)
+	if err == nil || !strings.Contains(err.Error(), "did you mean linux-docker-android-22.04") {
+		t.Errorf("expected the other apps to be validated when an app can't be listed, got %v", err)
+	}
+	if code := exitCode(err); code != exitCodeConfigError {
+		t.Errorf("expected exit code %d, got %d", exitCodeConfigError, code)
+	}
+
+	if err := validateStacks("api-token", []Key{unlisted}, false); err != nil {
+		t.Errorf("expected the unlisted app to be skipped, got %v", err)
+	}
+
+	err = validateStacks("api-token", []Key{unlisted}, true)
+	if err == nil {
+		t.Fatal("expected an error in strict mode")
+	}
+	if code := exitCode(err); code != exitCodeInfraError {
+		t.Errorf("expected exit code %d, got %d", exitCodeInfraError, code)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StateBuild is a triggered build persisted in the state file.
+type StateBuild struct {
+	KeyID     string `json:"key_id"`
+	AppSlug   string `json:"app_slug"`
+	BuildSlug string `json:"build_slug"`
+	// Attempt is the controller attempt which triggered the build.
+	Attempt int `json:"attempt"`
+}
+
+// RunState is the persisted state of a controller run.
+//
+// The triggered builds are saved as soon as they are started, so a restarted controller (with the same run ID)
+// resumes monitoring them instead of triggering duplicates.
+// A nil *RunState is valid and persists nothing.
+type RunState struct {
+	RunID string `json:"run_id"`
+	// Attempt counts the controller attempts of the run, starting from 1.
+	Attempt int          `json:"attempt"`
+	Builds  []StateBuild `json:"builds"`
+
+	path string
+}
+
+// LoadRunState reads the state file at path.
+// If the file doesn't exist, or it belongs to an other run, an empty state is returned.
+func LoadRunState(path, runID string) (*RunState, error) {
+	state := &RunState{
+		RunID:   runID,
+		Attempt: 1,
+		path:    path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %s", err)
+	}
+
+	var persisted RunState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("failed to parse state file (%s): %s", path, err)
+	}
+	if persisted.RunID != runID {
+		return state, nil
+	}
+
+	state.Attempt = persisted.Attempt + 1
+	state.Builds = persisted.Builds
+	return state, nil
+}
+
+// Find returns the persisted build of a key.
+func (s *RunState) Find(keyID string) (StateBuild, bool) {
+	if s == nil {
+		return StateBuild{}, false
+	}
+
+	for _, build := range s.Builds {
+		if build.KeyID == keyID {
+			return build, true
+		}
+	}
+	return StateBuild{}, false
+}
+
+// Add records a build triggered by the current attempt and saves the state file.
+func (s *RunState) Add(build StateBuild) error {
+	if s == nil {
+		return nil
+	}
+
+	build.Attempt = s.Attempt
+	s.Builds = append(s.Builds, build)
+	return s.save()
+}
+
+// Reset forgets the persisted builds, the attempts of the run are still counted.
+func (s *RunState) Reset() error {
+	if s == nil {
+		return nil
+	}
+
+	s.Builds = nil
+	return s.save()
+}
+
+func (s *RunState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash never leaves a truncated state file behind.
+	tmpPath := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state file: %s", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to write state file: %s", err)
+	}
+	return nil
+}
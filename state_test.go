@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunState_Attempts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	first, err := LoadRunState(path, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Add(StateBuild{KeyID: "linux", AppSlug: testAppSlug, BuildSlug: "build-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := LoadRunState(path, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Attempt != 2 {
+		t.Errorf("expected attempt 2, got %d", second.Attempt)
+	}
+	if build, ok := second.Find("linux"); !ok || build.Attempt != 1 {
+		t.Errorf("expected the build of attempt 1 to be resumed, got %+v (%t)", build, ok)
+	}
+
+	if err := second.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	third, err := LoadRunState(path, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := third.Find("linux"); ok || third.Attempt != 3 {
+		t.Errorf("expected no builds at attempt 3, got %+v", third)
+	}
+
+	other, err := LoadRunState(path, "other-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Attempt != 1 {
+		t.Errorf("expected an other run to start from attempt 1, got %d", other.Attempt)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultHangMessageTemplate   = `Potential hanging build: {{ .BuildInfo.URL }}`
+	defaultQueueMessageTemplate  = `Build is waiting for a worker for {{ .Elapsed }}: {{ .BuildInfo.URL }}`
+	defaultResultMessageTemplate = `[{{ .Key.ID }}] {{ .BuildInfo.RawStatus }}: {{ .BuildInfo.URL }} ({{ .BuildInfo.Duration }}){{ with .BuildInfo.AbortSummary }}, {{ . }}{{ end }}`
+)
+
+// MessageData is the data model the notification templates are rendered against.
+//
+// Example: `{{ .Key.ID }} is hanging for {{ .Elapsed }}: {{ .BuildInfo.URL }} (runbook: {{ index .Env "RUNBOOK_URL" }})`
+type MessageData struct {
+	// Key is the matrix entry the build was triggered for.
+	Key Key
+	// Build is the last polled state of the build, as returned by the Bitrise API.
+	Build Build
+	// BuildInfo is the summary of the build, as shown in the results table.
+	BuildInfo BuildInfo
+	// Elapsed is the time passed since the controller started to monitor the build.
+	Elapsed time.Duration
+	// Env holds the environment variables of the parent build.
+	Env map[string]string
+	// LogTail holds the last lines of the build log, only set for log inactivity based hang warnings.
+	LogTail string
+}
+
+func parseMessageTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", name, err)
+	}
+	return tmpl, nil
+}
+
+func renderMessage(tmpl *template.Template, data MessageData) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render %s: %s", tmpl.Name(), err)
+	}
+	return b.String(), nil
+}
+
+func parentEnvs() map[string]string {
+	envs := map[string]string{}
+	for _, e := range os.Environ() {
+		if idx := strings.Index(e, "="); idx != -1 {
+			envs[e[:idx]] = e[idx+1:]
+		}
+	}
+	return envs
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,12 +23,61 @@ import (
 
 // Key ...
 type Key struct {
+	AppSlug     string
 	Stack       string
 	MachineType string
 	Workflow    string
-	ID          string
-	Envs        map[string]string
-	RepoOwner   string
+	// Pipeline is triggered instead of the Workflow, if set.
+	Pipeline  string
+	ID        string
+	Envs      []BuildParamsEnvironment
+	RepoOwner string
+	// Git overrides the git parameters inherited from the parent build.
+	Git GitParams
+	// PullRequest simulates a pull request trigger, if set.
+	PullRequest *PullRequestParams
+
+	// triggerToken is the app's build trigger token, if empty the build is triggered through the REST API.
+	triggerToken string
+}
+
+// target returns the triggered workflow, or pipeline (prefixed with pipeline:).
+func (k Key) target() string {
+	if k.Pipeline != "" {
+		return "pipeline:" + k.Pipeline
+	}
+	return k.Workflow
+}
+
+// PullRequestParams describe the simulated pull request of a triggered build.
+type PullRequestParams struct {
+	ID int
+	// RepositoryURL is the pull request's source repository, required for fork pull requests.
+	RepositoryURL string
+	HeadBranch    string
+	MergeBranch   string
+	// ForkOwner is the owner of the source repository of a fork pull request.
+	ForkOwner string
+}
+
+// Validate ...
+func (pr PullRequestParams) Validate() error {
+	if pr.ID <= 0 {
+		return fmt.Errorf("invalid pull request ID: %d", pr.ID)
+	}
+	if pr.ForkOwner != "" && pr.RepositoryURL == "" {
+		return fmt.Errorf("the pull request repository URL is required for fork pull requests")
+	}
+	return nil
+}
+
+// GitParams are the git parameters of a triggered build, empty values are inherited from the parent build.
+type GitParams struct {
+	Branch        string
+	BranchDest    string
+	CommitHash    string
+	Tag           string
+	CommitMessage string
 }
 
 type buildKey struct {
@@ -34,7 +85,16 @@ type buildKey struct {
 	key           Key
 }
 
+// url returns the web URL of the triggered build, or pipeline.
+func (b buildKey) url() string {
+	if b.key.Pipeline != "" {
+		return pipelineURL(b.triggerResult.AppSlug, b.triggerResult.BuildSlug)
+	}
+	return buildURL(b.triggerResult.BuildSlug)
+}
+
 // BuildTriggerResponse ...
+// When a pipeline is triggered, BuildSlug holds the pipeline's ID.
 type BuildTriggerResponse struct {
 	Status    string `json:"status"`
 	AppSlug   string `json:"slug"`
@@ -50,7 +110,7 @@ type BuildTriggerParams struct {
 // BuildTriggerParamsHookInfo ...
 type BuildTriggerParamsHookInfo struct {
 	Type              string `json:"type" example:"bitrise"` // Should be "bitrise"
-	BuildTriggerToken string `json:"build_trigger_token"`
+	BuildTriggerToken string `json:"build_trigger_token,omitempty"`
 }
 
 // BuildTriggerParamsBuildParams ...
@@ -66,7 +126,8 @@ type BuildTriggerParamsBuildParams struct {
 	PullRequestRepositoryURL string                   `json:"pull_request_repository_url" env:"BITRISEIO_PULL_REQUEST_REPOSITORY_URL"`
 	PullRequestMergeBranch   string                   `json:"pull_request_merge_branch" env:"BITRISEIO_PULL_REQUEST_MERGE_BRANCH"`
 	PullRequestHeadBranch    string                   `json:"pull_request_head_branch" env:"BITRISEIO_PULL_REQUEST_HEAD_BRANCH"`
-	WorkflowID               string                   `json:"workflow_id"`
+	WorkflowID               string                   `json:"workflow_id,omitempty"`
+	PipelineID               string                   `json:"pipeline_id,omitempty"`
 	SkipGitStatusReport      bool                     `json:"skip_git_status_report"`
 	Environments             []BuildParamsEnvironment `json:"environments"`
 	Worker                   struct {
@@ -82,43 +143,244 @@ type BuildParamsEnvironment struct {
 	IsExpand bool   `json:"is_expand"`
 }
 
-// ExecuteWorkflows ...
-func ExecuteWorkflows(triggerToken string, apiToken string, appSlug string, keys Key, hangingBuildWarning HangingBuildWarning) (map[string]BuildInfo, error) {
+// ExecuteWorkflows triggers a build for each key and monitors them until they finish.
+// Builds already persisted in the run state are resumed instead of being triggered again.
+func ExecuteWorkflows(ctx context.Context, apiToken string, keys []Key, reuseRunningBuild bool, state *RunState, policy OutcomePolicy, hangingBuildWarning HangingBuildWarning, notifications Notifications) (map[string]BuildInfo, error) {
 	fmt.Println()
 	log.Infof("Trigger Workflows")
 
-	startedBuild, err := triggerWorkflow(triggerToken, appSlug, keys)
-	if err != nil {
-		return nil, err
+	var startedBuilds []buildKey
+	// abortStartedBuilds aborts the started builds concurrently, within a single abortTimeout, and returns their build infos.
+	abortStartedBuilds := func(reason string) map[string]BuildInfo {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+
+		var buildInfos = map[string]BuildInfo{}
+		var mux sync.Mutex
+		var wg sync.WaitGroup
+		for _, build := range startedBuilds {
+			wg.Add(1)
+			go func(build buildKey) {
+				defer wg.Done()
+
+				appSlug := build.triggerResult.AppSlug
+				abort := abortBuilds
+				if build.key.Pipeline != "" {
+					// BuildSlug holds the pipeline's ID.
+					abort = abortPipeline
+				}
+				message, aborted := abort(ctx, apiToken, appSlug, build.triggerResult.BuildSlug, build.key.ID, reason)
+				log.Warnf(message)
+
+				buildInfo := getBuildInfo(build.key.ID, build.triggerResult.BuildSlug, StatusInProgress, colorstring.NoColor(StatusInProgress), "-")
+				buildInfo.URL = build.url()
+				buildInfo.App = appSlug
+				if aborted {
+					buildInfo.markAbortedByController(reason)
+				}
+
+				mux.Lock()
+				buildInfos[build.key.ID] = buildInfo
+				mux.Unlock()
+			}(build)
+		}
+		wg.Wait()
+
+		// The aborted builds shouldn't be resumed by the next attempt.
+		if err := state.Reset(); err != nil {
+			log.Warnf("%s", err)
+		}
+		return buildInfos
+	}
+
+	for _, key := range keys {
+		if persisted, ok := state.Find(key.ID); ok && persisted.AppSlug == key.AppSlug {
+			resumedBuild := buildKey{
+				triggerResult: BuildTriggerResponse{
+					Status:    "ok",
+					AppSlug:   persisted.AppSlug,
+					BuildSlug: persisted.BuildSlug,
+				},
+				key: key,
+			}
+			log.Printf("Resuming %s (triggered by attempt %d): %s", key.ID, persisted.Attempt, resumedBuild.url())
+			startedBuilds = append(startedBuilds, resumedBuild)
+			continue
+		}
+
+		startedBuild, err := triggerWorkflow(apiToken, key, reuseRunningBuild)
+		if err != nil {
+			abortStartedBuilds(abortReasonTriggerFailed)
+			return nil, err
+		}
+		startedBuilds = append(startedBuilds, *startedBuild)
+
+		if err := state.Add(StateBuild{
+			KeyID:     key.ID,
+			AppSlug:   startedBuild.triggerResult.AppSlug,
+			BuildSlug: startedBuild.triggerResult.BuildSlug,
+		}); err != nil {
+			abortStartedBuilds(abortReasonTriggerFailed)
+			return nil, err
+		}
+
+		if ctx.Err() != nil {
+			buildInfos := abortStartedBuilds(abortReasonInterrupted)
+
+			fmt.Println()
+			printBuildInfos(buildInfos)
+			runLog := NewRunLog(notifications)
+			runLog.Start(startedBuilds)
+			runLog.Finish(errInterrupted)
+
+			return buildInfos, errInterrupted
+		}
 	}
 
+	runLog := NewRunLog(notifications)
+	runLog.Start(startedBuilds)
+
+	return monitorBuilds(ctx, apiToken, startedBuilds, state, policy, hangingBuildWarning, runLog)
+}
+
+// AttachBuilds monitors already running builds, without triggering new ones.
+// A build can be referenced by its slug or by its URL.
+func AttachBuilds(ctx context.Context, apiToken string, appSlug string, buildRefs []string, policy OutcomePolicy, hangingBuildWarning HangingBuildWarning, notifications Notifications) (map[string]BuildInfo, error) {
+	fmt.Println()
+	log.Infof("Attach to Builds")
+
+	var attachedBuilds []buildKey
+	for _, buildRef := range buildRefs {
+		buildSlug := parseBuildSlug(buildRef)
+		build, err := GetBuild(apiToken, appSlug, buildSlug)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get build (%s): %s", buildRef, err)
+		}
+
+		key := Key{
+			AppSlug:     appSlug,
+			Stack:       build.StackIdentifier,
+			MachineType: build.MachineTypID,
+			Workflow:    build.OriginalBuildParams.WorkflowID,
+			ID:          fmt.Sprintf("%s #%d [%s]", build.OriginalBuildParams.WorkflowID, build.BuildNumber, buildSlug),
+		}
+		log.Printf("Attached to %s", key.ID)
+
+		attachedBuilds = append(attachedBuilds, buildKey{
+			triggerResult: BuildTriggerResponse{
+				Status:    "ok",
+				AppSlug:   appSlug,
+				BuildSlug: buildSlug,
+			},
+			key: key,
+		})
+	}
+
+	runLog := NewRunLog(notifications)
+	runLog.Start(attachedBuilds)
+
+	return monitorBuilds(ctx, apiToken, attachedBuilds, nil, policy, hangingBuildWarning, runLog)
+}
+
+func monitorBuilds(ctx context.Context, apiToken string, builds []buildKey, state *RunState, policy OutcomePolicy, hangingBuildWarning HangingBuildWarning, runLog *RunLog) (map[string]BuildInfo, error) {
 	fmt.Println()
 	log.Infof("Monitoring Workflows")
 
-	buildInfos, err := monitorRunningBuilds(apiToken, *startedBuild, hangingBuildWarning)
+	buildInfos, err := monitorRunningBuilds(ctx, apiToken, builds, policy, hangingBuildWarning, runLog)
+
+	// Builds aborted by the controller (fail-fast, interrupt) shouldn't be resumed by the next attempt.
+	for _, buildInfo := range buildInfos {
+		if buildInfo.AbortCause == AbortCauseController {
+			if err := state.Reset(); err != nil {
+				log.Warnf("%s", err)
+			}
+			break
+		}
+	}
+
 	printBuildInfos(buildInfos)
+	runLog.Finish(err)
 
 	return buildInfos, err
 }
 
-func triggerWorkflow(triggerToken, appSlug string, key Key) (*buildKey, error) {
+// parseBuildSlug returns the build slug of a build reference, which is either a build slug
+// or a build URL (like https://app.bitrise.io/build/<slug>).
+func parseBuildSlug(buildRef string) string {
+	buildRef = strings.TrimSpace(buildRef)
+	if idx := strings.Index(buildRef, "/build/"); idx != -1 {
+		buildRef = buildRef[idx+len("/build/"):]
+	}
+	if idx := strings.IndexAny(buildRef, "/?#"); idx != -1 {
+		buildRef = buildRef[:idx]
+	}
+	return buildRef
+}
+
+// DryRunWorkflows resolves and validates the build trigger parameters, and prints what would be triggered,
+// without starting any builds.
+func DryRunWorkflows(keys []Key) error {
+	fmt.Println()
+	log.Infof("Dry run: resolving Workflows")
+
+	for _, key := range keys {
+		fmt.Println()
+		log.Printf("Resolving %s", key.ID)
+		params, err := newBuildTriggerParams(key, key.triggerToken)
+		if err != nil {
+			return fmt.Errorf("failed to create buildparams: %s", err)
+		}
+		if err := validateBuildTriggerParams(params); err != nil {
+			return fmt.Errorf("[%s] invalid buildparams: %s", key.ID, err)
+		}
+
+		log.Printf("Would POST to: %s", triggerURL(key.triggerToken, key.AppSlug))
+		log.Printf("Params:\n%s", pretty.Object(params))
+	}
+
+	fmt.Println()
+	log.Donef("Dry run finished, no builds were triggered")
+
+	return nil
+}
+
+// triggerWorkflow starts a build through the legacy build trigger hook if a trigger token is given,
+// otherwise through the authenticated REST API with the personal access token.
+// If reuseRunningBuild is set and an identical build is already running, that build is returned instead.
+func triggerWorkflow(apiToken string, key Key, reuseRunningBuild bool) (*buildKey, error) {
+	triggerToken := key.triggerToken
+	appSlug := key.AppSlug
+
 	log.Printf("Starting %s", key.ID)
 	params, err := newBuildTriggerParams(key, triggerToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create buildparams: %s", err)
 	}
+	if err := validateBuildTriggerParams(params); err != nil {
+		return nil, fmt.Errorf("[%s] invalid buildparams: %s", key.ID, err)
+	}
 
-	// TODO investigate issue with several commit messages, then remove
-	params.BuildParams.CommitMessage = ""
-
-	if key.RepoOwner != "" {
-		params.BuildParams.BranchRepoOwner = key.RepoOwner
-		params.BuildParams.BranchDestRepoOwner = key.RepoOwner
+	if reuseRunningBuild && key.Pipeline == "" {
+		build, err := findRunningBuild(apiToken, appSlug, key, params.BuildParams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look for running builds: %s", err)
+		}
+		if build != nil {
+			log.Printf("Reusing the identical running build: %s", buildURL(build.Slug))
+			return &buildKey{
+				triggerResult: BuildTriggerResponse{
+					Status:    "ok",
+					AppSlug:   appSlug,
+					BuildSlug: build.Slug,
+				},
+				key: key,
+			}, nil
+		}
 	}
 
 	log.Printf("Params:\n%s", pretty.Object(params))
 
-	url := "https://app.bitrise.io/app/" + appSlug + "/build/start.json"
+	url := triggerURL(triggerToken, appSlug)
 
 	data, err := json.Marshal(params)
 	if err != nil {
@@ -130,7 +392,12 @@ func triggerWorkflow(triggerToken, appSlug string, key Key) (*buildKey, error) {
 		return nil, err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if triggerToken == "" {
+		req.Header.Add("Authorization", fmt.Sprintf("token %s", apiToken))
+		req.Header.Add("Content-type", "application/json")
+	}
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -170,33 +437,144 @@ func triggerWorkflow(triggerToken, appSlug string, key Key) (*buildKey, error) {
 	}, nil
 }
 
-func monitorRunningBuilds(apiToken string, startedBuild buildKey, hangingBuildWarning HangingBuildWarning) (map[string]BuildInfo, error) {
+// findRunningBuild returns the app's running build which was started with the same parameters, if any.
+func findRunningBuild(apiToken, appSlug string, key Key, buildParams BuildTriggerParamsBuildParams) (*Build, error) {
+	builds, err := ListRunningBuilds(apiToken, appSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, build := range builds {
+		if isSameBuild(build, key, buildParams) {
+			return &build, nil
+		}
+	}
+	return nil, nil
+}
+
+// isSameBuild compares a running build with the build which would be triggered
+// on workflow, branch, commit, stack, machine type and envs.
+func isSameBuild(build Build, key Key, buildParams BuildTriggerParamsBuildParams) bool {
+	original := build.OriginalBuildParams
+	if original.WorkflowID != buildParams.WorkflowID ||
+		original.Branch != buildParams.Branch ||
+		original.CommitHash != buildParams.CommitHash ||
+		build.StackIdentifier != key.Stack ||
+		build.MachineTypID != key.MachineType {
+		return false
+	}
+
+	if len(original.Envrironments) != len(buildParams.Environments) {
+		return false
+	}
+	envs := map[string]string{}
+	for _, env := range original.Envrironments {
+		envs[env.MappedTo] = env.Value
+	}
+	for _, env := range buildParams.Environments {
+		if value, ok := envs[env.MappedTo]; !ok || value != env.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func triggerURL(triggerToken, appSlug string) string {
+	if triggerToken == "" {
+		return fmt.Sprintf("%s/apps/%s/builds", baseURL, appSlug)
+	}
+	return appBaseURL + "/app/" + appSlug + "/build/start.json"
+}
+
+// monitorRunningBuilds polls the started builds until they finish.
+// If a build fails, or the parent context is cancelled (the controller is interrupted),
+// the builds still in progress are aborted.
+func monitorRunningBuilds(parentCtx context.Context, apiToken string, startedBuilds []buildKey, policy OutcomePolicy, hangingBuildWarning HangingBuildWarning, runLog *RunLog) (map[string]BuildInfo, error) {
 	var buildInfos = map[string]BuildInfo{}
 	var messages []string
 	var mux sync.Mutex
+	// outcomes holds the outcome of each entry (a pipeline is a single entry).
+	outcomes := map[string]string{}
 
 	var wg sync.WaitGroup
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
-	wg.Add(1)
-
 	var buildErr error
-
-	appSlug := startedBuild.triggerResult.AppSlug
-	buildSlug := startedBuild.triggerResult.BuildSlug
-	id := startedBuild.key.ID
-	go func() {
-		defer wg.Done()
-		build, err := pollBuild(ctx, apiToken, appSlug, buildSlug, id, hangingBuildWarning)
-		if err != nil {
+	setBuildErr := func(err error) {
+		mux.Lock()
+		if buildErr == nil {
 			buildErr = err
-			cancel()
 		}
-		mux.Lock()
-		buildInfos[id] = build
 		mux.Unlock()
-	}()
+		cancel()
+	}
+
+	abortReason := func() string {
+		if parentCtx.Err() != nil {
+			return abortReasonInterrupted
+		}
+		return abortReasonFailFast
+	}
+
+	for _, startedBuild := range startedBuilds {
+		wg.Add(1)
+
+		appSlug := startedBuild.triggerResult.AppSlug
+		buildSlug := startedBuild.triggerResult.BuildSlug
+		key := startedBuild.key
+		go func() {
+			defer wg.Done()
+			if key.Pipeline != "" {
+				workflows, status := pollPipeline(ctx, apiToken, appSlug, buildSlug, key, hangingBuildWarning, runLog, abortReason)
+				outcome := policy.Outcome(pipelineBuildStatus(status))
+				if outcome == OutcomeFail && !policy.Tolerates(key.ID) {
+					setBuildErr(withExitCode(exitCodeSomeFailed, fmt.Errorf("[%s] pipeline %s", key.ID, status)))
+				}
+				mux.Lock()
+				outcomes[key.ID] = outcome
+				for workflowID, build := range workflows {
+					build.App = appSlug
+					buildInfos[workflowID] = build
+				}
+				mux.Unlock()
+				return
+			}
+
+			result, err := pollBuild(ctx, apiToken, appSlug, buildSlug, key, hangingBuildWarning, runLog)
+			build := result.BuildInfo
+			if err != nil && policy.Outcome(build.RawStatus) == OutcomeFail && !policy.Tolerates(key.ID) {
+				setBuildErr(err)
+			}
+
+			// The outcome is decided by the polled status, before the build is aborted.
+			outcome := policy.Outcome(build.RawStatus)
+
+			var message string
+			if !isFinalState(build.RawStatus) {
+				reason := abortReason()
+				if build.RawStatus == StatusUnknown && err != nil {
+					reason = abortReasonUnknownStatus
+				}
+				var aborted bool
+				if message, aborted = abortBuilds(context.Background(), apiToken, appSlug, buildSlug, key.ID, reason); aborted {
+					build.markAbortedByController(reason)
+				}
+			}
+
+			build.App = appSlug
+			result.BuildInfo = build
+			runLog.NotifyResult(result)
+
+			mux.Lock()
+			buildInfos[key.ID] = build
+			outcomes[key.ID] = outcome
+			if message != "" {
+				messages = append(messages, message)
+			}
+			mux.Unlock()
+		}()
+	}
 
 	wg.Wait()
 
@@ -206,46 +584,115 @@ func monitorRunningBuilds(apiToken string, startedBuild buildKey, hangingBuildWa
 	if len(messages) > 0 {
 		for _, message := range messages {
 			log.Warnf(message)
+			runLog.Post(message)
 		}
 
 		fmt.Println()
 	}
 
-	return buildInfos, buildErr
+	if parentCtx.Err() != nil {
+		return buildInfos, errInterrupted
+	}
+
+	if buildErr != nil {
+		return buildInfos, buildErr
+	}
+	return buildInfos, policy.Evaluate(outcomes)
 }
 
 // BuildInfo ...
 type BuildInfo struct {
-	Status    string
-	RawStatus string
-	URL       string
-	ID        string
-	Duration  string
+	// Status is the colored status, as shown in the results table.
+	Status    string `json:"-"`
+	RawStatus string `json:"status"`
+	URL       string `json:"url"`
+	ID        string `json:"id"`
+	Duration  string `json:"duration"`
+	// App is the slug of the build's app.
+	App string `json:"app"`
+	// Stage is the pipeline stage of the build, only set for pipeline workflows.
+	Stage string `json:"stage,omitempty"`
+	// AbortReason, AbortCause (one of the AbortCause... consts) and AbortedBy are only set for aborted builds.
+	AbortReason string `json:"abort_reason,omitempty"`
+	AbortCause  string `json:"abort_cause,omitempty"`
+	AbortedBy   string `json:"aborted_by,omitempty"`
+	stageIndex  int
+}
+
+func sortedBuildInfos(buildInfos map[string]BuildInfo) []BuildInfo {
+	var sorted []BuildInfo
+	for _, buildInfo := range buildInfos {
+		sorted = append(sorted, buildInfo)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].App != sorted[j].App {
+			return sorted[i].App < sorted[j].App
+		}
+		if sorted[i].stageIndex != sorted[j].stageIndex {
+			return sorted[i].stageIndex < sorted[j].stageIndex
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
 }
 
 func printBuildInfos(buildInfos map[string]BuildInfo) {
 	table := simpletable.New()
 
-	table.Header = &simpletable.Header{
-		Cells: []*simpletable.Cell{
-			{Align: simpletable.AlignCenter, Text: "ID"},
-			{Align: simpletable.AlignCenter, Text: "DURATION"},
-			{Align: simpletable.AlignCenter, Text: "URL"},
-			{Align: simpletable.AlignCenter, Text: "STATUS"},
-		},
-	}
+	hasStages := false
+	hasAborts := false
+	apps := map[string]bool{}
 	for _, buildInfo := range buildInfos {
-		r := []*simpletable.Cell{
+		if buildInfo.Stage != "" {
+			hasStages = true
+		}
+		if buildInfo.AbortCause != "" {
+			hasAborts = true
+		}
+		apps[buildInfo.App] = true
+	}
+	hasApps := len(apps) > 1
+
+	var header []*simpletable.Cell
+	if hasApps {
+		header = append(header, &simpletable.Cell{Align: simpletable.AlignCenter, Text: "APP"})
+	}
+	if hasStages {
+		header = append(header, &simpletable.Cell{Align: simpletable.AlignCenter, Text: "STAGE"})
+	}
+	header = append(header, []*simpletable.Cell{
+		{Align: simpletable.AlignCenter, Text: "ID"},
+		{Align: simpletable.AlignCenter, Text: "DURATION"},
+		{Align: simpletable.AlignCenter, Text: "URL"},
+		{Align: simpletable.AlignCenter, Text: "STATUS"},
+	}...)
+	if hasAborts {
+		header = append(header, &simpletable.Cell{Align: simpletable.AlignCenter, Text: "ABORT"})
+	}
+	table.Header = &simpletable.Header{Cells: header}
+
+	for _, buildInfo := range sortedBuildInfos(buildInfos) {
+		var r []*simpletable.Cell
+		if hasApps {
+			r = append(r, &simpletable.Cell{Text: buildInfo.App})
+		}
+		if hasStages {
+			r = append(r, &simpletable.Cell{Text: buildInfo.Stage})
+		}
+		r = append(r, []*simpletable.Cell{
 			{Text: buildInfo.ID},
 			{Text: buildInfo.Duration},
 			{Text: buildInfo.URL},
 			{Align: simpletable.AlignRight, Text: buildInfo.Status},
+		}...)
+		if hasAborts {
+			r = append(r, &simpletable.Cell{Text: buildInfo.AbortSummary()})
 		}
 
 		table.Body.Cells = append(table.Body.Cells, r)
 	}
 	table.SetStyle(simpletable.StyleUnicode)
-	fmt.Println(table.String())
+	fmt.Println(secrets.Redact(table.String()))
 	fmt.Println()
 }
 
@@ -260,26 +707,121 @@ func newBuildTriggerParams(key Key, triggerToken string) (BuildTriggerParams, er
 
 	params.HookInfo.Type = "bitrise"
 
-	for key, value := range key.Envs {
-		params.BuildParams.Environments = append(params.BuildParams.Environments, BuildParamsEnvironment{
-			MappedTo: key,
-			Value:    value,
-			IsExpand: true,
-		})
+	applyGitParams(&params.BuildParams, key.Git)
+
+	if key.RepoOwner != "" {
+		params.BuildParams.BranchRepoOwner = key.RepoOwner
+		params.BuildParams.BranchDestRepoOwner = key.RepoOwner
 	}
 
-	if key.Stack != "" {
-		params.BuildParams.Worker.StackID = key.Stack
+	if key.PullRequest != nil {
+		applyPullRequestParams(&params.BuildParams, *key.PullRequest)
 	}
-	if key.MachineType != "" {
-		params.BuildParams.Worker.MachineTypeID = key.MachineType
+
+	params.BuildParams.Environments = append(params.BuildParams.Environments, key.Envs...)
+
+	if key.Pipeline != "" {
+		// The pipeline's workflows run on the stacks and machine types set in the bitrise.yml.
+		params.BuildParams.PipelineID = key.Pipeline
+	} else {
+		params.BuildParams.WorkflowID = key.Workflow
+		if key.Stack != "" {
+			params.BuildParams.Worker.StackID = key.Stack
+		}
+		if key.MachineType != "" {
+			params.BuildParams.Worker.MachineTypeID = key.MachineType
+		}
 	}
-	params.BuildParams.WorkflowID = key.Workflow
 	params.BuildParams.SkipGitStatusReport = true
 
 	return params, nil
 }
 
+// validateBuildTriggerParams runs the pre-flight checks of the resolved build trigger parameters.
+func validateBuildTriggerParams(params BuildTriggerParams) error {
+	buildParams := params.BuildParams
+	if buildParams.WorkflowID == "" && buildParams.PipelineID == "" {
+		return fmt.Errorf("neither workflow nor pipeline is set")
+	}
+	if buildParams.Branch == "" && buildParams.Tag == "" && buildParams.CommitHash == "" {
+		return fmt.Errorf("one of branch, tag or commit hash is required (set the inputs, or run in a build which has them)")
+	}
+	if buildParams.PullRequestID != 0 {
+		if buildParams.Branch == "" {
+			return fmt.Errorf("the pull request's source branch is not set")
+		}
+		if buildParams.BranchDest == "" {
+			return fmt.Errorf("the pull request's destination branch is not set")
+		}
+	}
+	return nil
+}
+
+// applyGitParams overrides the git parameters inherited from the parent build.
+// Overriding the branch or the tag without a commit hash drops the inherited commit,
+// otherwise the triggered build would check out the parent build's commit instead of the branch or tag.
+// Once the inherited commit is replaced, its message is dropped too.
+func applyGitParams(buildParams *BuildTriggerParamsBuildParams, git GitParams) {
+	if git.CommitHash != "" || git.Branch != "" || git.Tag != "" {
+		// The inherited commit and message belong to the parent build's checkout.
+		buildParams.CommitHash = ""
+		buildParams.CommitMessage = ""
+	}
+
+	if git.CommitHash != "" {
+		buildParams.CommitHash = git.CommitHash
+	}
+	if git.Branch != "" {
+		buildParams.Branch = git.Branch
+	}
+	if git.BranchDest != "" {
+		buildParams.BranchDest = git.BranchDest
+	}
+	if git.Tag != "" {
+		buildParams.Tag = git.Tag
+	}
+	if git.CommitMessage != "" {
+		buildParams.CommitMessage = git.CommitMessage
+	}
+
+	buildParams.CommitMessage = normalizeCommitMessage(buildParams.CommitMessage)
+}
+
+// normalizeCommitMessage prepares a (possibly multi-line) commit message to be forwarded to a triggered build.
+// The parent's BITRISE_GIT_MESSAGE may hold the messages of several commits with CRLF line endings and
+// trailing whitespace, the message is forwarded with LF line endings and without trailing whitespace.
+func normalizeCommitMessage(message string) string {
+	message = strings.ReplaceAll(message, "\r\n", "\n")
+	message = strings.ReplaceAll(message, "\r", "\n")
+
+	lines := strings.Split(message, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// applyPullRequestParams makes the triggered build look like it was started by a pull request.
+// The head and merge branches default to the GitHub pull request refs.
+func applyPullRequestParams(buildParams *BuildTriggerParamsBuildParams, pr PullRequestParams) {
+	buildParams.PullRequestID = pr.ID
+	buildParams.PullRequestHeadBranch = pr.HeadBranch
+	if buildParams.PullRequestHeadBranch == "" {
+		buildParams.PullRequestHeadBranch = fmt.Sprintf("pull/%d/head", pr.ID)
+	}
+	buildParams.PullRequestMergeBranch = pr.MergeBranch
+	if buildParams.PullRequestMergeBranch == "" {
+		buildParams.PullRequestMergeBranch = fmt.Sprintf("pull/%d/merge", pr.ID)
+	}
+	if pr.RepositoryURL != "" {
+		buildParams.PullRequestRepositoryURL = pr.RepositoryURL
+	}
+	if pr.ForkOwner != "" {
+		buildParams.BranchRepoOwner = pr.ForkOwner
+	}
+}
+
 // Build statuses
 const (
 	StatusOnHold = "on-hold" // 0 + IsOnHold is true
@@ -297,99 +839,167 @@ const (
 	StatusUnknown = "unknown"
 )
 
+// HangingBuildWarning configures when a build is reported as potentially hanging.
 type HangingBuildWarning struct {
-	Timeout    time.Duration
-	WebhookURL string
-	Channel    string
+	// Mode is either HangDetectionWallClock or HangDetectionLogInactivity.
+	Mode string
+	// Timeout is measured from the build's start on a worker.
+	Timeout time.Duration
+	// LogInactivityTimeout is the inactivity window of the HangDetectionLogInactivity mode.
+	LogInactivityTimeout time.Duration
+	// QueueTimeout is the time a build may wait for a worker before it is reported, 0 disables the warning.
+	QueueTimeout time.Duration
 }
 
-func pollBuild(ctx context.Context, apiToken string, appSlug string, buildSlug string, id string, hangingBuildWarning HangingBuildWarning) (BuildInfo, error) {
-	time.AfterFunc(hangingBuildWarning.Timeout, func() {
-		buildURL := "https://app.bitrise.io/build/" + buildSlug
-		log.Warnf("Potentially hanging build: %s", buildURL)
-		message := Message{
-			Channel:  hangingBuildWarning.Channel,
-			Text:     "Potential hanging build: " + buildURL,
-			Username: "hanging-build-bot",
-		}
+// pollBuild monitors a build until it finishes, or ctx is cancelled.
+// It returns the last state of the build, the result notification is sent by the caller,
+// once the build's final status (including an abort of the controller) is known.
+func pollBuild(ctx context.Context, apiToken string, appSlug string, buildSlug string, key Key, hangingBuildWarning HangingBuildWarning, runLog *RunLog) (MessageData, error) {
+	id := key.ID
+	startTime := time.Now()
+	envs := parentEnvs()
 
-		if err := postMessage(message, "", hangingBuildWarning.WebhookURL); err != nil {
-			log.Errorf("Failed to warn about potentially hanging build: %s", err)
+	var mux sync.Mutex
+	var build Build
+	messageData := func() MessageData {
+		mux.Lock()
+		defer mux.Unlock()
+		return MessageData{
+			Key:       key,
+			Build:     build,
+			BuildInfo: getBuildInfo(id, buildSlug, buildState(build), buildState(build), calculateDuration(build)),
+			Elapsed:   time.Since(startTime),
+			Env:       envs,
 		}
+	}
+
+	timers := startHangTimers(hangingBuildWarning, func() {
+		log.Warnf("Build is waiting for a worker for %s: %s", hangingBuildWarning.QueueTimeout, buildURL(buildSlug))
+		runLog.NotifyQueued(messageData())
+	}, func() {
+		log.Warnf("Potentially hanging build: %s", buildURL(buildSlug))
+		runLog.NotifyHang(messageData())
+	})
+	defer timers.stop()
+
+	var watcher *logWatcher
+
+	result := func(buildInfo BuildInfo) MessageData {
+		data := messageData()
+		data.BuildInfo = buildInfo
+		return data
+	}
+
+	states := newBuildStateMachine(id)
+	states.OnTransition(func(from, to string, build Build) {
+		runLog.Post("[%s] Status: %s", id, to)
 	})
 
 	for {
-		build, err := GetBuild(apiToken, appSlug, buildSlug)
+		polledBuild, err := GetBuild(apiToken, appSlug, buildSlug)
 		if err != nil {
 			fmt.Println()
 			log.Errorf("[%s] Failed to get build: %s", id, err)
-			time.Sleep(10 * time.Second)
+			runLog.Post("[%s] Failed to get build, retrying: %s", id, err)
+			select {
+			case <-ctx.Done():
+				// The build's state is unknown, report it as in progress so the caller aborts it.
+				return result(getBuildInfo(id, buildSlug, StatusInProgress, colorstring.NoColor(StatusInProgress), "unknown")), nil
+			case <-time.After(pollInterval):
+			}
 			continue
 		}
+
+		mux.Lock()
+		build = polledBuild
+		mux.Unlock()
 		duration := calculateDuration(build)
+		state := states.Update(build)
 
-		switch build.StatusText {
-		case StatusOnHold, StatusInProgress:
-			fmt.Print(colorstring.NoColor("."))
-			time.Sleep(time.Second * 10)
-			continue
-		case StatusFinishedWithSuccess:
-			fmt.Print(colorstring.Green("."))
-			return getBuildInfo(id, buildSlug, build.StatusText, colorstring.Green(build.StatusText), duration), nil
-		case StatusFinishedWithError, StatusAborted, StatusAbortedWithSuccess, StatusUnknown:
-			err := getBuildError(id, build.StatusText)
-			var buildInfo BuildInfo
-			switch build.StatusText {
-			case StatusFinishedWithError:
-				fmt.Print(colorstring.Red("."))
-				buildInfo = getBuildInfo(id, buildSlug, build.StatusText, colorstring.Red(build.StatusText), duration)
-				select {
-				case <-ctx.Done():
-					return buildInfo, nil
-				default:
-					return buildInfo, err
-				}
+		if startedAt, ok := workerStartTime(build); ok {
+			timers.buildStarted(startedAt)
+			if watcher == nil && hangingBuildWarning.Mode == HangDetectionLogInactivity {
+				watcher = newLogWatcher(hangingBuildWarning.LogInactivityTimeout, time.Now())
+			}
+		}
 
-			case StatusAbortedWithSuccess:
-				fmt.Print(colorstring.Yellow("."))
-				buildInfo = getBuildInfo(id, buildSlug, build.StatusText, colorstring.Yellow(build.StatusText), duration)
-				select {
-				case <-ctx.Done():
-					return buildInfo, nil
-				default:
-					return buildInfo, err
-				}
+		if watcher != nil && state == StatusInProgress {
+			checkLogActivity(watcher, apiToken, appSlug, buildSlug, id, messageData, runLog)
+		}
 
-			case StatusUnknown:
-				fmt.Print(colorstring.Blue("."))
-				buildInfo = getBuildInfo(id, buildSlug, build.StatusText, colorstring.Blue(build.StatusText), duration)
-				select {
-				case <-ctx.Done():
-					return buildInfo, nil
-				default:
-					return buildInfo, err
-				}
+		color := stateColor(state)
+		buildInfo := getBuildInfo(id, buildSlug, state, color(state), duration)
+		if state == StatusAborted || state == StatusAbortedWithSuccess {
+			var reason string
+			if build.AbortReason != nil {
+				reason = *build.AbortReason
+			}
+			buildInfo.setAbort(reason)
+		}
 
-			case StatusAborted:
-				fmt.Print(colorstring.Yellow("."))
-				buildInfo = getBuildInfo(id, buildSlug, build.StatusText, colorstring.Yellow(build.StatusText), duration)
-				select {
-				case <-ctx.Done():
-					return buildInfo, nil
-				default:
-					return buildInfo, err
-				}
+		var buildErr error
+		if state == StatusUnknown && states.InStateFor() >= unknownStatusTimeout {
+			buildErr = withExitCode(exitCodeTimedOut, fmt.Errorf("[%s] build status is unrecognized for %s", id, unknownStatusTimeout))
+		} else if !isFinalState(state) {
+			fmt.Print(color("."))
+			select {
+			case <-ctx.Done():
+				// An other build failed, the caller aborts this one.
+				return result(buildInfo), nil
+			case <-time.After(pollInterval):
 			}
+			continue
+		} else if state != StatusFinishedWithSuccess {
+			buildErr = getBuildError(id, state)
+		}
+
+		fmt.Print(color("."))
+		if buildErr == nil {
+			return result(buildInfo), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return result(buildInfo), nil
+		default:
+			return result(buildInfo), buildErr
 		}
 	}
 }
 
-func abortBuilds(apiToken string, appSlug string, buildSlug string, id string) string {
-	_, err := AbortBuild(apiToken, appSlug, buildSlug)
+func checkLogActivity(watcher *logWatcher, apiToken, appSlug, buildSlug, id string, messageData func() MessageData, runLog *RunLog) {
+	buildLog, err := GetBuildLog(apiToken, appSlug, buildSlug)
 	if err != nil {
-		return fmt.Sprintf("[%s] Failed to abort build: %s", id, strings.TrimSpace(err.Error()))
+		fmt.Println()
+		log.Warnf("[%s] Failed to get build log: %s", id, err)
+		return
 	}
-	return fmt.Sprintf("[%s] Build aborted", id)
+
+	now := time.Now()
+	if !watcher.update(buildLog, now) {
+		return
+	}
+
+	fmt.Println()
+	log.Warnf("Potentially hanging build, no log output for %s: %s", watcher.InactiveFor(now).Round(time.Second), buildURL(buildSlug))
+	log.Printf("Last log lines:\n%s", watcher.Tail())
+
+	data := messageData()
+	data.LogTail = watcher.Tail()
+	runLog.NotifyHang(data)
+}
+
+// abortBuilds aborts a build on behalf of the controller, it returns the message describing the result and whether the build was aborted.
+// The abort request times out after abortTimeout, or earlier if ctx has an earlier deadline.
+func abortBuilds(ctx context.Context, apiToken string, appSlug string, buildSlug string, id string, reason string) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, abortTimeout)
+	defer cancel()
+
+	_, err := AbortBuild(ctx, apiToken, appSlug, buildSlug, controllerAbortPrefix+reason)
+	if err != nil {
+		return fmt.Sprintf("[%s] Failed to abort build: %s", id, strings.TrimSpace(err.Error())), false
+	}
+	return fmt.Sprintf("[%s] Build aborted: %s", id, reason), true
 }
 
 func calculateDuration(build Build) string {
@@ -412,15 +1022,19 @@ func calculateDuration(build Build) string {
 	return "unknown"
 }
 
+func buildURL(buildSlug string) string {
+	return appBaseURL + "/build/" + buildSlug
+}
+
 func getBuildError(id string, statusText string) error {
-	return fmt.Errorf("[%s] %s", id, statusText)
+	return withExitCode(exitCodeSomeFailed, fmt.Errorf("[%s] %s", id, statusText))
 }
 
 func getBuildInfo(id string, buildSlug string, status string, statusText string, durationText string) BuildInfo {
 	return BuildInfo{
 		RawStatus: status,
 		Status:    statusText,
-		URL:       "https://app.bitrise.io/build/" + buildSlug,
+		URL:       buildURL(buildSlug),
 		ID:        id,
 		Duration:  durationText,
 	}
@@ -428,8 +1042,10 @@ func getBuildInfo(id string, buildSlug string, status string, statusText string,
 
 // BuildOriginalBuildParams ...
 type BuildOriginalBuildParams struct {
-	Branch, WorkflowID string
-	Envrironments      []BuildParamsEnvironment `json:"environments"`
+	Branch        string                   `json:"branch"`
+	WorkflowID    string                   `json:"workflow_id"`
+	CommitHash    string                   `json:"commit_hash"`
+	Envrironments []BuildParamsEnvironment `json:"environments"`
 }
 
 // Build ...
@@ -448,9 +1064,15 @@ type Build struct {
 	OriginalBuildParams BuildOriginalBuildParams `json:"original_build_params"`
 }
 
-const (
-	baseURL = "https://api.bitrise.io/v0.1"
-)
+// abortTimeout bounds the abort requests, so an interrupted controller exits in time.
+const abortTimeout = 20 * time.Second
+
+// pollInterval is the time between two polls of a build or a pipeline (and between retries of a failed poll).
+// It is a variable, so the tests can speed up polling.
+var pollInterval = 10 * time.Second
+
+// errInterrupted is returned if the controller was interrupted (by SIGINT or SIGTERM) while running.
+var errInterrupted = errors.New("interrupted")
 
 // GetBuild ...
 func GetBuild(personalAccessToken, appSlug, buildSlug string) (Build, error) {
@@ -464,7 +1086,7 @@ func GetBuild(personalAccessToken, appSlug, buildSlug string) (Build, error) {
 	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
 	req.Header.Add("Content-type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return Build{}, err
 	}
@@ -497,16 +1119,124 @@ func GetBuild(personalAccessToken, appSlug, buildSlug string) (Build, error) {
 	return m.Data, nil
 }
 
+// ListRunningBuilds ...
+func ListRunningBuilds(personalAccessToken, appSlug string) ([]Build, error) {
+	url := fmt.Sprintf("%s/apps/%s/builds?status=0", baseURL, appSlug)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct list builds request (URL: %s): %s", url, err)
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
+	req.Header.Add("Content-type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		cErr := resp.Body.Close()
+		if cErr != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read list builds request response: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP response code (%d %s) not 200, response: %s", resp.StatusCode, resp.Status, data)
+	}
+
+	m := struct {
+		Data []Build `json:"data"`
+	}{}
+
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal list builds response: %s", err)
+	}
+
+	return m.Data, nil
+}
+
+// BuildLogChunk ...
+type BuildLogChunk struct {
+	Chunk    string `json:"chunk"`
+	Position int    `json:"position"`
+}
+
+// BuildLog ...
+type BuildLog struct {
+	LogChunks  []BuildLogChunk `json:"log_chunks"`
+	IsArchived bool            `json:"is_archived"`
+}
+
+// GetBuildLog ...
+func GetBuildLog(personalAccessToken, appSlug, buildSlug string) (BuildLog, error) {
+	url := fmt.Sprintf("%s/apps/%s/builds/%s/log", baseURL, appSlug, buildSlug)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return BuildLog{}, fmt.Errorf("failed to construct get build log request (URL: %s): %s", url, err)
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
+	req.Header.Add("Content-type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return BuildLog{}, err
+	}
+
+	defer func() {
+		cErr := resp.Body.Close()
+		if cErr != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return BuildLog{}, fmt.Errorf("failed to read get build log request response: %s", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return BuildLog{}, fmt.Errorf("HTTP response code (%d %s) not 200, response: %s", resp.StatusCode, resp.Status, data)
+	}
+
+	var buildLog BuildLog
+	if err := json.Unmarshal(data, &buildLog); err != nil {
+		return BuildLog{}, fmt.Errorf("failed to unmarshal get build log response: %s", err)
+	}
+
+	return buildLog, nil
+}
+
 // BuildAbortResponse ...
 type BuildAbortResponse struct {
 	Status string `json:"status"`
 }
 
+// BuildAbortParams ...
+type BuildAbortParams struct {
+	AbortReason string `json:"abort_reason"`
+}
+
 // AbortBuild ...
-func AbortBuild(personalAccessToken, appSlug, buildSlug string) (BuildAbortResponse, error) {
+func AbortBuild(ctx context.Context, personalAccessToken, appSlug, buildSlug, reason string) (BuildAbortResponse, error) {
 	url := fmt.Sprintf("%s/apps/%s/builds/%s/abort", baseURL, appSlug, buildSlug)
 
-	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader("{}"))
+	body, err := json.Marshal(BuildAbortParams{AbortReason: reason})
+	if err != nil {
+		return BuildAbortResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return BuildAbortResponse{}, fmt.Errorf("failed to construct get build request (URL: %s): %s", url, err)
 	}
@@ -514,7 +1244,7 @@ func AbortBuild(personalAccessToken, appSlug, buildSlug string) (BuildAbortRespo
 	req.Header.Add("Authorization", fmt.Sprintf("token %s", personalAccessToken))
 	req.Header.Add("Content-type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return BuildAbortResponse{}, err
 	}
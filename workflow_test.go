@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godrei/step-ctrl/internal/fakebitrise"
+)
+
+const testAppSlug = "test-app"
+
+// setupFakeBitrise points the controller at a fake Bitrise API (and website) with a fast poll interval.
+func setupFakeBitrise(t *testing.T) *fakebitrise.Server {
+	t.Helper()
+
+	server := fakebitrise.New()
+	origBaseURL, origAppBaseURL, origPollInterval := baseURL, appBaseURL, pollInterval
+	if err := setEndpoints(server.URL, server.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	pollInterval = 10 * time.Millisecond
+
+	t.Cleanup(func() {
+		server.Close()
+		baseURL, appBaseURL, pollInterval = origBaseURL, origAppBaseURL, origPollInterval
+	})
+	return server
+}
+
+// webhook records the messages posted to a Slack incoming webhook.
+type webhook struct {
+	*httptest.Server
+
+	mux      sync.Mutex
+	messages []string
+}
+
+func newWebhook(t *testing.T) *webhook {
+	t.Helper()
+
+	w := &webhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.mux.Lock()
+		w.messages = append(w.messages, msg.Text)
+		w.mux.Unlock()
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+func (w *webhook) Messages() []string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return append([]string(nil), w.messages...)
+}
+
+func testKey(stack, workflow string) Key {
+	return Key{
+		AppSlug:     testAppSlug,
+		Stack:       stack,
+		MachineType: "standard",
+		Workflow:    workflow,
+		ID:          stack + " [standard]",
+		Git:         GitParams{Branch: "main"},
+	}
+}
+
+func testPipelineKey(pipeline string) Key {
+	return Key{
+		AppSlug:  testAppSlug,
+		Pipeline: pipeline,
+		ID:       "pipeline:" + pipeline,
+		Git:      GitParams{Branch: "main"},
+	}
+}
+
+func testNotifications(t *testing.T, webhookURL string) Notifications {
+	t.Helper()
+
+	hangMessageTemplate, err := parseMessageTemplate("hang_message_template", defaultHangMessageTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueMessageTemplate, err := parseMessageTemplate("queue_message_template", defaultQueueMessageTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Notifications{
+		WebhookURL:           webhookURL,
+		Channel:              "#builds",
+		HangMessageTemplate:  hangMessageTemplate,
+		QueueMessageTemplate: queueMessageTemplate,
+	}
+}
+
+func testHangingBuildWarning() HangingBuildWarning {
+	return HangingBuildWarning{
+		Mode:    HangDetectionWallClock,
+		Timeout: time.Hour,
+	}
+}
+
+func TestExecuteWorkflows_Success(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("primary",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, IsOnHold: true, Polls: 1},
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 2},
+		fakebitrise.Phase{Status: fakebitrise.StatusSuccess},
+	)
+
+	keys := []Key{testKey("linux", "primary"), testKey("osx", "primary")}
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", keys, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(server.Triggers()) != 2 {
+		t.Errorf("expected 2 triggered builds, got %d", len(server.Triggers()))
+	}
+	for _, key := range keys {
+		if status := buildInfos[key.ID].RawStatus; status != StatusFinishedWithSuccess {
+			t.Errorf("[%s] expected status %s, got %s", key.ID, StatusFinishedWithSuccess, status)
+		}
+	}
+	if aborts := server.Aborts(); len(aborts) != 0 {
+		t.Errorf("expected no aborts, got %v", aborts)
+	}
+}
+
+func TestExecuteWorkflows_FailureAbortsOthers(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("failing",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 1},
+		fakebitrise.Phase{Status: fakebitrise.StatusError},
+	)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+
+	failing, slow := testKey("linux", "failing"), testKey("osx", "slow")
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{failing, slow}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if code := exitCode(err); code != exitCodeSomeFailed {
+		t.Errorf("expected exit code %d, got %d (%s)", exitCodeSomeFailed, code, err)
+	}
+
+	if status := buildInfos[failing.ID].RawStatus; status != StatusFinishedWithError {
+		t.Errorf("expected status %s, got %s", StatusFinishedWithError, status)
+	}
+	slowInfo := buildInfos[slow.ID]
+	if slowInfo.RawStatus != StatusAborted || slowInfo.AbortCause != AbortCauseController || slowInfo.AbortReason != abortReasonFailFast {
+		t.Errorf("expected the slow build to be aborted by the controller, got %+v", slowInfo)
+	}
+
+	aborts := server.Aborts()
+	if len(aborts) != 1 || aborts[0].AbortReason != controllerAbortPrefix+abortReasonFailFast {
+		t.Errorf("expected a single fail-fast abort, got %v", aborts)
+	}
+}
+
+func TestExecuteWorkflows_AbortedBuildResultNotification(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("failing",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 1},
+		fakebitrise.Phase{Status: fakebitrise.StatusError},
+	)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+
+	hook := newWebhook(t)
+	notifications := testNotifications(t, hook.URL)
+	resultMessageTemplate, err := parseMessageTemplate("result_message_template", defaultResultMessageTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifications.ResultMessageTemplate = resultMessageTemplate
+
+	slow := testKey("osx", "slow")
+	if _, err := ExecuteWorkflows(context.Background(), "api-token", []Key{testKey("linux", "failing"), slow}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), notifications); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := "[" + slow.ID + "] " + StatusAborted + ": "
+	for _, message := range hook.Messages() {
+		if strings.HasPrefix(message, want) {
+			if !strings.Contains(message, "aborted by controller: "+abortReasonFailFast) {
+				t.Errorf("expected the abort summary in the result notification, got %q", message)
+			}
+			return
+		}
+	}
+	t.Errorf("expected an aborted result notification for %s, got %v", slow.ID, hook.Messages())
+}
+
+func TestExecuteWorkflows_ToleratedFailure(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("failing", fakebitrise.Phase{Status: fakebitrise.StatusError})
+	server.Script("primary",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 3},
+		fakebitrise.Phase{Status: fakebitrise.StatusSuccess},
+	)
+
+	keys := []Key{testKey("linux", "primary"), testKey("osx", "primary"), testKey("experimental", "failing")}
+	policy := OutcomePolicy{}
+	if err := policy.SetQuorum("2", "linux [standard]", keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ExecuteWorkflows(context.Background(), "api-token", keys, false, nil, policy, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if aborts := server.Aborts(); len(aborts) != 0 {
+		t.Errorf("expected no aborts, got %v", aborts)
+	}
+}
+
+func TestExecuteWorkflows_HangWarning(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("primary",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 20},
+		fakebitrise.Phase{Status: fakebitrise.StatusSuccess},
+	)
+
+	hook := newWebhook(t)
+	hangingBuildWarning := HangingBuildWarning{
+		Mode:    HangDetectionWallClock,
+		Timeout: 50 * time.Millisecond,
+	}
+	if _, err := ExecuteWorkflows(context.Background(), "api-token", []Key{testKey("linux", "primary")}, false, nil, OutcomePolicy{}, hangingBuildWarning, testNotifications(t, hook.URL)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	messages := hook.Messages()
+	if len(messages) != 1 || !strings.Contains(messages[0], "Potential hanging build") {
+		t.Errorf("expected a single hang warning, got %v", messages)
+	}
+}
+
+func TestExecuteWorkflows_AbortedByUser(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("primary",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 1},
+		fakebitrise.Phase{Status: fakebitrise.StatusAborted, AbortReason: "User john requested to abort this build."},
+	)
+
+	key := testKey("linux", "primary")
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	buildInfo := buildInfos[key.ID]
+	if buildInfo.AbortCause != AbortCauseUser || buildInfo.AbortedBy != "john" {
+		t.Errorf("expected the build to be aborted by john, got %+v", buildInfo)
+	}
+}
+
+func TestExecuteWorkflows_Interrupted(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	keys := []Key{testKey("linux", "slow"), testKey("osx", "slow")}
+	buildInfos, err := ExecuteWorkflows(ctx, "api-token", keys, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+
+	if aborts := server.Aborts(); len(aborts) != 2 {
+		t.Errorf("expected 2 aborts, got %v", aborts)
+	}
+	for _, key := range keys {
+		if reason := buildInfos[key.ID].AbortReason; reason != abortReasonInterrupted {
+			t.Errorf("[%s] expected abort reason %q, got %q", key.ID, abortReasonInterrupted, reason)
+		}
+	}
+}
+
+func TestExecuteWorkflows_InterruptedWhileTriggering(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+	server.Delay(fakebitrise.EndpointTrigger, 50*time.Millisecond)
+	server.Delay(fakebitrise.EndpointAbort, 200*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+	defer cancel()
+
+	keys := []Key{testKey("linux", "slow"), testKey("osx", "slow")}
+	start := time.Now()
+	buildInfos, err := ExecuteWorkflows(ctx, "api-token", keys, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+
+	// The aborts run concurrently, one after the other they would take 400ms.
+	if elapsed := time.Since(start); elapsed >= 350*time.Millisecond {
+		t.Errorf("expected the builds to be aborted concurrently, took %s", elapsed)
+	}
+	if aborts := server.Aborts(); len(aborts) != len(keys) {
+		t.Errorf("expected %d aborts, got %v", len(keys), aborts)
+	}
+	for _, key := range keys {
+		buildInfo := buildInfos[key.ID]
+		if buildInfo.RawStatus != StatusAborted || buildInfo.AbortReason != abortReasonInterrupted {
+			t.Errorf("[%s] expected the build to be aborted by the interrupt, got %+v", key.ID, buildInfo)
+		}
+	}
+}
+
+func TestExecuteWorkflows_PipelineInterruptedWhileTriggering(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.ScriptPipeline("release", fakebitrise.Stage{Name: "build", Workflows: []string{"slow"}})
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+	server.Delay(fakebitrise.EndpointTrigger, 50*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 75*time.Millisecond)
+	defer cancel()
+
+	keys := []Key{testPipelineKey("release"), testKey("osx", "slow")}
+	buildInfos, err := ExecuteWorkflows(ctx, "api-token", keys, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+
+	var pipelineAborts, buildAborts int
+	for _, abort := range server.Aborts() {
+		if abort.PipelineID != "" {
+			pipelineAborts++
+		} else {
+			buildAborts++
+		}
+	}
+	if pipelineAborts != 1 || buildAborts != 1 {
+		t.Errorf("expected the pipeline and the build to be aborted, got %v", server.Aborts())
+	}
+	for _, key := range keys {
+		if reason := buildInfos[key.ID].AbortReason; reason != abortReasonInterrupted {
+			t.Errorf("[%s] expected abort reason %q, got %q", key.ID, abortReasonInterrupted, reason)
+		}
+	}
+}
+
+func TestExecuteWorkflows_InterruptedResetsState(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadRunState(path, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := ExecuteWorkflows(ctx, "api-token", []Key{testKey("linux", "slow")}, false, state, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL)); !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+
+	restarted, err := LoadRunState(path, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Find(testKey("linux", "slow").ID); ok {
+		t.Error("expected the build aborted by the controller not to be resumed")
+	}
+}
+
+func TestExecuteWorkflows_UnknownStatusTimeout(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.Script("primary", fakebitrise.Phase{Status: 9})
+
+	origUnknownStatusTimeout := unknownStatusTimeout
+	unknownStatusTimeout = 50 * time.Millisecond
+	defer func() { unknownStatusTimeout = origUnknownStatusTimeout }()
+
+	key := testKey("linux", "primary")
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if code := exitCode(err); code != exitCodeTimedOut {
+		t.Errorf("expected exit code %d, got %d (%v)", exitCodeTimedOut, code, err)
+	}
+
+	aborts := server.Aborts()
+	if len(aborts) != 1 || aborts[0].AbortReason != controllerAbortPrefix+abortReasonUnknownStatus {
+		t.Errorf("expected the build to be aborted, got %v", aborts)
+	}
+	if reason := buildInfos[key.ID].AbortReason; reason != abortReasonUnknownStatus {
+		t.Errorf("expected abort reason %q, got %q", abortReasonUnknownStatus, reason)
+	}
+}
+
+func TestExecuteWorkflows_Pipeline(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.ScriptPipeline("release",
+		fakebitrise.Stage{Name: "build", Workflows: []string{"primary"}},
+		fakebitrise.Stage{Name: "deploy", Workflows: []string{"deploy"}},
+	)
+	server.Script("primary",
+		fakebitrise.Phase{Status: fakebitrise.StatusRunning, Polls: 2},
+		fakebitrise.Phase{Status: fakebitrise.StatusSuccess},
+	)
+
+	key := testPipelineKey("release")
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var params BuildTriggerParams
+	if err := json.Unmarshal(server.Triggers()[0].Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	if worker := params.BuildParams.Worker; worker.StackID != "" || worker.MachineTypeID != "" {
+		t.Errorf("expected no stack or machine type for the pipeline, got %+v", worker)
+	}
+
+	for _, id := range []string{key.ID + " / build / primary", key.ID + " / deploy / deploy"} {
+		if status := buildInfos[id].RawStatus; status != StatusFinishedWithSuccess {
+			t.Errorf("[%s] expected status %s, got %s", id, StatusFinishedWithSuccess, status)
+		}
+	}
+}
+
+func TestExecuteWorkflows_PipelineInterrupted(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.ScriptPipeline("release",
+		fakebitrise.Stage{Name: "build", Workflows: []string{"slow"}},
+		fakebitrise.Stage{Name: "deploy", Workflows: []string{"deploy"}},
+	)
+	server.Script("slow", fakebitrise.Phase{Status: fakebitrise.StatusRunning})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	key := testPipelineKey("release")
+	buildInfos, err := ExecuteWorkflows(ctx, "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+
+	aborts := server.Aborts()
+	if len(aborts) != 1 || aborts[0].PipelineID == "" || aborts[0].AbortReason != controllerAbortPrefix+abortReasonInterrupted {
+		t.Errorf("expected the pipeline to be aborted, got %v", aborts)
+	}
+	slow := buildInfos[key.ID+" / build / slow"]
+	if slow.RawStatus != StatusAborted || slow.AbortReason != abortReasonInterrupted {
+		t.Errorf("expected the running workflow to be aborted with the pipeline, got %+v", slow)
+	}
+	if _, ok := buildInfos[key.ID+" / deploy / deploy"]; ok {
+		t.Errorf("expected the next stage not to start, got %+v", buildInfos)
+	}
+}
+
+func TestExecuteWorkflows_TriggerError(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.FailRequests(fakebitrise.EndpointTrigger, http.StatusInternalServerError, 1)
+
+	_, err := ExecuteWorkflows(context.Background(), "api-token", []Key{testKey("linux", "primary")}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if code := exitCode(err); code != exitCodeInfraError {
+		t.Errorf("expected exit code %d, got %d (%s)", exitCodeInfraError, code, err)
+	}
+}
+
+func TestExecuteWorkflows_GetBuildErrorIsRetried(t *testing.T) {
+	server := setupFakeBitrise(t)
+	server.FailRequests(fakebitrise.EndpointGetBuild, http.StatusBadGateway, 3)
+	server.Delay(fakebitrise.EndpointGetBuild, 5*time.Millisecond)
+
+	key := testKey("linux", "primary")
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status := buildInfos[key.ID].RawStatus; status != StatusFinishedWithSuccess {
+		t.Errorf("expected status %s, got %s", StatusFinishedWithSuccess, status)
+	}
+}
+
+func TestExecuteWorkflows_TriggerHook(t *testing.T) {
+	server := setupFakeBitrise(t)
+
+	key := testKey("linux", "primary")
+	key.triggerToken = "trigger-token"
+	buildInfos, err := ExecuteWorkflows(context.Background(), "api-token", []Key{key}, false, nil, OutcomePolicy{}, testHangingBuildWarning(), testNotifications(t, newWebhook(t).URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	triggers := server.Triggers()
+	if len(triggers) != 1 || !triggers[0].Hook {
+		t.Fatalf("expected a single build triggered through the hook, got %v", triggers)
+	}
+	if url := buildInfos[key.ID].URL; url != server.URL+"/build/"+triggers[0].BuildSlug {
+		t.Errorf("expected the build URL to be on the configured app host, got %s", url)
+	}
+}
+
+func TestApplyGitParams(t *testing.T) {
+	inherited := BuildTriggerParamsBuildParams{
+		Branch:        "main",
+		CommitHash:    "parentsha",
+		CommitMessage: "Merge feature \r\n\r\nFirst commit  \r\nSecond commit\t\r\n",
+	}
+
+	for _, tc := range []struct {
+		name        string
+		git         GitParams
+		wantBranch  string
+		wantTag     string
+		wantCommit  string
+		wantMessage string
+	}{
+		{name: "inherited", wantBranch: "main", wantCommit: "parentsha", wantMessage: "Merge feature\n\nFirst commit\nSecond commit"},
+		{name: "branch", git: GitParams{Branch: "feature"}, wantBranch: "feature"},
+		{name: "tag", git: GitParams{Tag: "1.0.0"}, wantBranch: "main", wantTag: "1.0.0"},
+		{name: "branch and commit", git: GitParams{Branch: "feature", CommitHash: "pinned"}, wantBranch: "feature", wantCommit: "pinned"},
+		{name: "commit message", git: GitParams{CommitHash: "pinned", CommitMessage: "Pinned\r\n"}, wantBranch: "main", wantCommit: "pinned", wantMessage: "Pinned"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buildParams := inherited
+			applyGitParams(&buildParams, tc.git)
+
+			if buildParams.Branch != tc.wantBranch || buildParams.Tag != tc.wantTag || buildParams.CommitHash != tc.wantCommit {
+				t.Errorf("expected branch=%q tag=%q commit=%q, got branch=%q tag=%q commit=%q", tc.wantBranch, tc.wantTag, tc.wantCommit, buildParams.Branch, buildParams.Tag, buildParams.CommitHash)
+			}
+			if buildParams.CommitMessage != tc.wantMessage {
+				t.Errorf("expected commit message %q, got %q", tc.wantMessage, buildParams.CommitMessage)
+			}
+		})
+	}
+}
+
+func TestWriteResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	buildInfos := map[string]BuildInfo{
+		"linux": {RawStatus: StatusFinishedWithSuccess, ID: "linux", App: testAppSlug},
+		"osx":   {RawStatus: StatusAborted, ID: "osx", App: testAppSlug, AbortCause: AbortCauseUser, AbortedBy: "john", AbortReason: "User john requested to abort this build."},
+	}
+	if err := writeResults(path, buildInfos); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results struct {
+		Builds []map[string]string `json:"builds"`
+	}
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results.Builds) != 2 {
+		t.Fatalf("expected 2 builds, got %s", data)
+	}
+	aborted := results.Builds[1]
+	if aborted["id"] != "osx" || aborted["status"] != StatusAborted || aborted["abort_cause"] != AbortCauseUser || aborted["aborted_by"] != "john" || aborted["abort_reason"] == "" {
+		t.Errorf("unexpected aborted build: %v", aborted)
+	}
+	if _, ok := results.Builds[0]["abort_cause"]; ok {
+		t.Errorf("expected no abort fields for a successful build, got %v", results.Builds[0])
+	}
+}
+
+func TestPipelineOutcome(t *testing.T) {
+	policy, err := NewOutcomePolicy(StatusAbortedWithSuccess, StatusAborted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for status, want := range map[string]string{
+		PipelineStatusSucceeded:          OutcomePass,
+		PipelineStatusSucceededWithAbort: OutcomePass,
+		PipelineStatusAborted:            OutcomeNeutral,
+		PipelineStatusFailed:             OutcomeFail,
+		PipelineStatusRunning:            OutcomeFail,
+	} {
+		if outcome := policy.Outcome(pipelineBuildStatus(status)); outcome != want {
+			t.Errorf("[%s] expected outcome %s, got %s", status, want, outcome)
+		}
+	}
+}